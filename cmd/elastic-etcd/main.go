@@ -9,14 +9,35 @@ import (
 )
 
 func joinEnv(r *elastic.EtcdConfig) map[string]string {
-	return map[string]string{
+	vars := map[string]string{
 		"ETCD_INITIAL_CLUSTER":             strings.Join(r.InitialCluster, ","),
 		"ETCD_INITIAL_CLUSTER_STATE":       r.InitialClusterState,
 		"ETCD_INITIAL_ADVERTISE_PEER_URLS": r.AdvertisePeerURLs,
 		"ETCD_DISCOVERY":                   r.Discovery,
+		"ETCD_DISCOVERY_SRV":               r.DiscoverySRV,
 		"ETCD_NAME":                        r.Name,
 		"ETCD_DATA_DIR":                    r.DataDir,
 	}
+
+	if r.Proxy != "" {
+		vars["ETCD_PROXY"] = r.Proxy
+	}
+
+	tlsVars := map[string]string{
+		"ETCD_PEER_CERT_FILE":       r.PeerTLS.CertFile,
+		"ETCD_PEER_KEY_FILE":        r.PeerTLS.KeyFile,
+		"ETCD_PEER_TRUSTED_CA_FILE": r.PeerTLS.TrustedCAFile,
+		"ETCD_CERT_FILE":            r.ClientTLS.CertFile,
+		"ETCD_KEY_FILE":             r.ClientTLS.KeyFile,
+		"ETCD_TRUSTED_CA_FILE":      r.ClientTLS.TrustedCAFile,
+	}
+	for k, v := range tlsVars {
+		if v != "" {
+			vars[k] = v
+		}
+	}
+
+	return vars
 }
 
 func printFlags(r *elastic.EtcdConfig) {
@@ -0,0 +1,144 @@
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"golang.org/x/net/context"
+)
+
+// Backend is a source of truth for the machines of a cluster.
+type Backend interface {
+	// Machines returns the machines registered in the backend.
+	Machines(ctx context.Context) ([]Machine, error)
+
+	// Size returns the target cluster size stored in the backend.
+	Size(ctx context.Context) (int, error)
+
+	// Add registers a Machine. It returns false if the machine was registered before.
+	Add(ctx context.Context, m *Machine) (bool, error)
+
+	// Delete deregisters the machine with the given id. It returns false if the
+	// machine was not registered.
+	Delete(ctx context.Context, id string) (bool, error)
+}
+
+// Bootstrapper is implemented by backends which etcd itself can use with its
+// -discovery flag to bootstrap a new cluster.
+type Bootstrapper interface {
+	// DiscoveryURL returns the value for etcd's -discovery flag.
+	DiscoveryURL() string
+}
+
+// Config holds the backend independent parameters to create a Backend.
+type Config struct {
+	// ClientPort is used to derive client urls from peer urls.
+	ClientPort int
+
+	// Username and Password authenticate against the discovery service.
+	Username string
+	Password string
+
+	// TLS holds the client certificate and the trusted CAs for the discovery service.
+	TLS transport.TLSInfo
+
+	// ServerName overrides the host name to verify the server certificate against.
+	ServerName string
+
+	// Proxy is the url of a HTTP(S) proxy. If empty, the proxy is taken from the
+	// environment.
+	Proxy string
+}
+
+// Transport creates a http.Transport for the TLS and proxy settings of the Config.
+func (cfg Config) Transport() (*http.Transport, error) {
+	tr, err := transport.NewTransport(cfg.TLS, discoveryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ServerName != "" {
+		tr.TLSClientConfig.ServerName = cfg.ServerName
+	}
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %q: %v", cfg.Proxy, err)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	return tr, nil
+}
+
+// HTTPClient creates a http.Client for the TLS and proxy settings of the Config.
+func (cfg Config) HTTPClient() (*http.Client, error) {
+	tr, err := cfg.Transport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// BackendFactory creates a Backend for a discovery url.
+type BackendFactory func(discoveryURL string, cfg Config) (Backend, error)
+
+var (
+	backendsLock sync.Mutex
+	backends     = map[string]BackendFactory{}
+	schemes      = map[string]string{}
+)
+
+// RegisterBackend makes a backend available under the given name. The backend
+// is selected by default for discovery urls with one of the given schemes.
+func RegisterBackend(name string, f BackendFactory, urlSchemes ...string) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if _, found := backends[name]; found {
+		panic(fmt.Sprintf("discovery backend %q registered twice", name))
+	}
+	backends[name] = f
+	for _, s := range urlSchemes {
+		schemes[s] = name
+	}
+}
+
+// Backends returns the sorted names of all registered backends.
+func Backends() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	names := make([]string, 0, len(backends))
+	for n := range backends {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend creates the backend with the given name for a discovery url. If
+// the name is empty, the backend is selected by the url scheme.
+func NewBackend(name, discoveryURL string, cfg Config) (Backend, error) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if name == "" {
+		u, err := url.Parse(discoveryURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid discovery url %q: %v", discoveryURL, err)
+		}
+		var found bool
+		if name, found = schemes[u.Scheme]; !found {
+			return nil, fmt.Errorf("no discovery backend for scheme %q of discovery url %q", u.Scheme, discoveryURL)
+		}
+	}
+
+	f, found := backends[name]
+	if !found {
+		return nil, fmt.Errorf("unknown discovery backend %q", name)
+	}
+	return f(discoveryURL, cfg)
+}
@@ -2,10 +2,13 @@ package discovery
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,20 +23,132 @@ const (
 	discoveryTimeout = time.Second * 30
 )
 
-// Value reads a value from a discovery url.
-func Value(ctx context.Context, baseURL, key string) (*store.Event, error) {
+func init() {
+	RegisterBackend("http", func(discoveryURL string, cfg Config) (Backend, error) {
+		return NewHTTPBackend(discoveryURL, cfg)
+	}, "http", "https")
+}
+
+type httpBackend struct {
+	baseURL    string
+	clientPort int
+	client     *http.Client
+}
+
+// NewHTTPBackend creates a Backend speaking the discovery.etcd.io protocol.
+func NewHTTPBackend(baseURL string, cfg Config) (Backend, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discovery url %q: %v", baseURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("discovery url must use http or https scheme")
+	}
+
+	c, err := cfg.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpBackend{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		clientPort: cfg.ClientPort,
+		client:     c,
+	}, nil
+}
+
+// String returns the discovery url.
+func (b *httpBackend) String() string {
+	return b.baseURL
+}
+
+// DiscoveryURL returns the discovery url which etcd understands natively.
+func (b *httpBackend) DiscoveryURL() string {
+	return b.baseURL
+}
+
+// Machines returns the machines registered in the discovery url.
+func (b *httpBackend) Machines(ctx context.Context) ([]Machine, error) {
+	res, err := b.value(ctx, "/")
+	if err != nil {
+		return nil, err
+	}
+	records, err := b.records(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]Machine, 0, len(res.Node.Nodes))
+	for _, nn := range res.Node.Nodes {
+		if nn.Value == nil {
+			glog.V(5).Infof("Skipping %q because no value exists", nn.Key)
+			continue
+		}
+		n, err := NewDiscoveryNode(*nn.Value, records[path.Base(nn.Key)], b.clientPort)
+		if err != nil {
+			glog.Warningf("invalid peer url %q in discovery service: %v", *nn.Value, err)
+			continue
+		}
+		nodes = append(nodes, *n)
+	}
+	return nodes, nil
+}
+
+// records returns the extended machine records by id.
+func (b *httpBackend) records(ctx context.Context) (map[string]*Record, error) {
+	res, err := b.value(ctx, "/"+recordDir)
+	if serr, ok := err.(*statusError); ok && serr.code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string]*Record{}
+	for _, nn := range res.Node.Nodes {
+		if nn.Value == nil {
+			continue
+		}
+		rec, err := ParseRecord(*nn.Value)
+		if err != nil {
+			glog.Warningf("invalid machine record %q in discovery service: %v", *nn.Value, err)
+			continue
+		}
+		records[path.Base(nn.Key)] = rec
+	}
+	return records, nil
+}
+
+// Size returns the target cluster size of the discovery url.
+func (b *httpBackend) Size(ctx context.Context) (int, error) {
+	res, err := b.value(ctx, "/_config/size")
+	if err != nil {
+		return 0, err
+	}
+	if res.Node == nil || res.Node.Value == nil {
+		return 0, fmt.Errorf("no size value in %s", b.baseURL)
+	}
+	size, err := strconv.ParseInt(*res.Node.Value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size value %q in %s: %v", *res.Node.Value, b.baseURL, err)
+	}
+	return int(size), nil
+}
+
+// value reads a value from the discovery url.
+func (b *httpBackend) value(ctx context.Context, key string) (*store.Event, error) {
 	ctx, _ = context.WithTimeout(ctx, discoveryTimeout)
 
-	url := baseURL + key
+	url := b.baseURL + key
 	glog.V(6).Infof("Getting %s", url)
-	resp, err := ctxhttp.Get(ctx, http.DefaultClient, url)
+	resp, err := ctxhttp.Get(ctx, b.client, url)
 	if err != nil {
 		return nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
 	if resp.StatusCode != http.StatusOK {
 		body, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("status code %d from %q: %s", resp.StatusCode, url, body)
+		return nil, &statusError{resp.StatusCode, fmt.Sprintf("status code %d from %q: %s", resp.StatusCode, url, body)}
 	}
 
 	var res store.Event
@@ -47,16 +162,43 @@ func Value(ctx context.Context, baseURL, key string) (*store.Event, error) {
 	return &res, nil
 }
 
-// Delete remove a given machine from a discovery url.
-func Delete(ctx context.Context, baseURL, id string) (bool, error) {
+// Delete remove a given machine from the discovery url.
+func (b *httpBackend) Delete(ctx context.Context, id string) (bool, error) {
+	id = strings.TrimLeft(id, "/")
+	found, err := b.delete(ctx, "/"+id)
+	if err != nil {
+		return false, err
+	}
+	if _, err := b.delete(ctx, "/"+recordDir+"/"+id); err != nil {
+		return found, err
+	}
+	return found, nil
+}
+
+// Add adds a Machine to the discovery url. The extended record is written as well,
+// even if the machine existed before.
+func (b *httpBackend) Add(ctx context.Context, n *Machine) (bool, error) {
+	added, err := b.put(ctx, "/"+n.ID, strings.Join(n.NamedPeerURLs(), ","))
+	if err != nil {
+		return false, err
+	}
+	if rec := n.Record(); rec != nil {
+		if _, err := b.put(ctx, "/"+recordDir+"/"+n.ID, rec.String()); err != nil {
+			return added, err
+		}
+	}
+	return added, nil
+}
+
+func (b *httpBackend) delete(ctx context.Context, key string) (bool, error) {
 	ctx, _ = context.WithTimeout(ctx, discoveryTimeout)
 
-	url := baseURL + "/" + strings.TrimLeft(id, "/")
+	url := b.baseURL + key
 	req, err := http.NewRequest("DELETE", url, strings.NewReader(""))
 	if err != nil {
 		return false, err
 	}
-	resp, err := ctxhttp.Do(ctx, http.DefaultClient, req)
+	resp, err := ctxhttp.Do(ctx, b.client, req)
 	if err != nil {
 		return false, err
 	}
@@ -66,18 +208,16 @@ func Delete(ctx context.Context, baseURL, id string) (bool, error) {
 	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := ioutil.ReadAll(resp.Body)
-		return false, fmt.Errorf("status code %d on DELETE for %q: %s", resp.StatusCode, url, body)
+		return false, &statusError{resp.StatusCode, fmt.Sprintf("status code %d on DELETE for %q: %s", resp.StatusCode, url, body)}
 	}
 
 	return true, nil
 }
 
-// Add adds a Machine to a discovery url.
-func Add(ctx context.Context, baseURL string, n *Machine) (bool, error) {
+func (b *httpBackend) put(ctx context.Context, key, value string) (bool, error) {
 	ctx, _ = context.WithTimeout(ctx, discoveryTimeout)
 
-	u := baseURL + "/" + n.ID
-	value := strings.Join(n.NamedPeerURLs(), ",")
+	u := b.baseURL + key
 	data := url.Values{}
 	data.Set("value", value)
 
@@ -87,7 +227,7 @@ func Add(ctx context.Context, baseURL string, n *Machine) (bool, error) {
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := ctxhttp.Do(ctx, http.DefaultClient, req)
+	resp, err := ctxhttp.Do(ctx, b.client, req)
 	if err != nil {
 		return false, err
 	}
@@ -97,8 +237,17 @@ func Add(ctx context.Context, baseURL string, n *Machine) (bool, error) {
 	}
 	if resp.StatusCode != http.StatusCreated {
 		body, _ := ioutil.ReadAll(resp.Body)
-		return false, fmt.Errorf("status code %d on PUT for %q: %s", resp.StatusCode, u, body)
+		return false, &statusError{resp.StatusCode, fmt.Sprintf("status code %d on PUT for %q: %s", resp.StatusCode, u, body)}
 	}
 
 	return true, nil
 }
+
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
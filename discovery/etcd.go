@@ -0,0 +1,225 @@
+package discovery
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const keysPrefix = "/v2/keys"
+
+func init() {
+	RegisterBackend("etcd", func(discoveryURL string, cfg Config) (Backend, error) {
+		return NewEtcdBackend(discoveryURL, cfg)
+	}, "etcd", "etcds")
+}
+
+type etcdBackend struct {
+	kapi         client.KeysAPI
+	endpoint     string
+	dir          string
+	discoveryURL string
+	clientPort   int
+}
+
+// NewEtcdBackend creates a Backend which stores the machines in a directory of an
+// etcd cluster, using the v2 keys API. The directory is given as url of the form
+// http(s)://host:port/v2/keys/some/dir or etcd(s)://host:port/some/dir.
+func NewEtcdBackend(discoveryURL string, cfg Config) (Backend, error) {
+	u, err := url.Parse(discoveryURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discovery url %q: %v", discoveryURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "etcd":
+		u.Scheme = "http"
+	case "etcds":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("discovery url %q must use etcd, etcds, http or https scheme", discoveryURL)
+	}
+
+	dir := path.Clean("/" + strings.TrimPrefix(u.Path, keysPrefix))
+	if dir == "/" {
+		return nil, fmt.Errorf("discovery url %q must point to a directory below the root", discoveryURL)
+	}
+
+	username, password := cfg.Username, cfg.Password
+	if username == "" && u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	tr, err := cfg.Transport()
+	if err != nil {
+		return nil, err
+	}
+
+	// the discovery url for etcd itself, with the credentials only if given inline
+	du := *u
+	du.Path = keysPrefix + dir
+	u.User = nil
+	u.Path = ""
+
+	c, err := client.New(client.Config{
+		Endpoints:               []string{u.String()},
+		Transport:               tr,
+		Username:                username,
+		Password:                password,
+		HeaderTimeoutPerRequest: discoveryTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdBackend{
+		kapi:         client.NewKeysAPI(c),
+		endpoint:     u.String(),
+		dir:          dir,
+		discoveryURL: du.String(),
+		clientPort:   cfg.ClientPort,
+	}, nil
+}
+
+// String returns the endpoint and the directory of the backend.
+func (b *etcdBackend) String() string {
+	return b.endpoint + keysPrefix + b.dir
+}
+
+// DiscoveryURL returns the directory as etcd discovery url. Note that etcd itself
+// only passes credentials which are part of the url, but no client certificates.
+func (b *etcdBackend) DiscoveryURL() string {
+	return b.discoveryURL
+}
+
+// Machines returns the machines registered in the directory.
+func (b *etcdBackend) Machines(ctx context.Context) ([]Machine, error) {
+	ctx, _ = context.WithTimeout(ctx, discoveryTimeout)
+
+	glog.V(6).Infof("Getting %s", b)
+	resp, err := b.kapi.Get(ctx, b.dir, &client.GetOptions{Sort: true})
+	if err != nil {
+		if isEtcdError(err, client.ErrorCodeKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	records, err := b.records(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]Machine, 0, len(resp.Node.Nodes))
+	for _, nn := range resp.Node.Nodes {
+		if nn.Dir || nn.Value == "" {
+			glog.V(5).Infof("Skipping %q because no value exists", nn.Key)
+			continue
+		}
+		n, err := NewDiscoveryNode(nn.Value, records[path.Base(nn.Key)], b.clientPort)
+		if err != nil {
+			glog.Warningf("invalid peer url %q in discovery service: %v", nn.Value, err)
+			continue
+		}
+		nodes = append(nodes, *n)
+	}
+	return nodes, nil
+}
+
+// records returns the extended machine records by id.
+func (b *etcdBackend) records(ctx context.Context) (map[string]*Record, error) {
+	resp, err := b.kapi.Get(ctx, path.Join(b.dir, recordDir), nil)
+	if err != nil {
+		if isEtcdError(err, client.ErrorCodeKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	records := map[string]*Record{}
+	for _, nn := range resp.Node.Nodes {
+		if nn.Dir {
+			continue
+		}
+		rec, err := ParseRecord(nn.Value)
+		if err != nil {
+			glog.Warningf("invalid machine record %q in discovery service: %v", nn.Value, err)
+			continue
+		}
+		records[path.Base(nn.Key)] = rec
+	}
+	return records, nil
+}
+
+// Size returns the target cluster size stored in the _config/size key of the directory.
+func (b *etcdBackend) Size(ctx context.Context) (int, error) {
+	ctx, _ = context.WithTimeout(ctx, discoveryTimeout)
+
+	key := path.Join(b.dir, "_config", "size")
+	resp, err := b.kapi.Get(ctx, key, nil)
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(resp.Node.Value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size value %q in %s: %v", resp.Node.Value, key, err)
+	}
+	return int(size), nil
+}
+
+// Add adds a Machine to the directory unless a machine with the same id exists. The
+// extended record is written in any case.
+func (b *etcdBackend) Add(ctx context.Context, n *Machine) (bool, error) {
+	ctx, _ = context.WithTimeout(ctx, discoveryTimeout)
+
+	added := true
+	value := strings.Join(n.NamedPeerURLs(), ",")
+	_, err := b.kapi.Set(ctx, path.Join(b.dir, n.ID), value, &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+	})
+	if err != nil {
+		if !isEtcdError(err, client.ErrorCodeNodeExist) {
+			return false, err
+		}
+		added = false
+	}
+
+	if rec := n.Record(); rec != nil {
+		if _, err := b.kapi.Set(ctx, path.Join(b.dir, recordDir, n.ID), rec.String(), nil); err != nil {
+			return added, err
+		}
+	}
+	return added, nil
+}
+
+// Delete removes a given machine from the directory.
+func (b *etcdBackend) Delete(ctx context.Context, id string) (bool, error) {
+	ctx, _ = context.WithTimeout(ctx, discoveryTimeout)
+
+	found := true
+	_, err := b.kapi.Delete(ctx, path.Join(b.dir, id), nil)
+	if err != nil {
+		if !isEtcdError(err, client.ErrorCodeKeyNotFound) {
+			return false, err
+		}
+		found = false
+	}
+
+	_, err = b.kapi.Delete(ctx, path.Join(b.dir, recordDir, id), nil)
+	if err != nil && !isEtcdError(err, client.ErrorCodeKeyNotFound) {
+		return found, err
+	}
+	return found, nil
+}
+
+func isEtcdError(err error, code int) bool {
+	cerr, ok := err.(client.Error)
+	return ok && cerr.Code == code
+}
@@ -0,0 +1,242 @@
+package discovery
+
+import (
+	"errors"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// fakeKeysAPI is an in-memory KeysAPI with flat keys. Directories exist implicitly
+// through the keys below them. If err is set, every call fails with it.
+type fakeKeysAPI struct {
+	client.KeysAPI
+	values map[string]string
+	err    error
+}
+
+func (f *fakeKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if v, found := f.values[key]; found {
+		return &client.Response{Node: &client.Node{Key: key, Value: v}}, nil
+	}
+
+	dir := &client.Node{Key: key, Dir: true}
+	subdirs := map[string]bool{}
+	for k, v := range f.values {
+		if !strings.HasPrefix(k, key+"/") {
+			continue
+		}
+		child := strings.SplitN(strings.TrimPrefix(k, key+"/"), "/", 2)[0]
+		if path.Join(key, child) == k {
+			dir.Nodes = append(dir.Nodes, &client.Node{Key: k, Value: v})
+		} else if !subdirs[child] {
+			subdirs[child] = true
+			dir.Nodes = append(dir.Nodes, &client.Node{Key: path.Join(key, child), Dir: true})
+		}
+	}
+	if len(dir.Nodes) == 0 {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound}
+	}
+	sort.Sort(dir.Nodes)
+	return &client.Response{Node: dir}, nil
+}
+
+func (f *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if _, found := f.values[key]; found && opts != nil && opts.PrevExist == client.PrevNoExist {
+		return nil, client.Error{Code: client.ErrorCodeNodeExist}
+	}
+	f.values[key] = value
+	return &client.Response{Node: &client.Node{Key: key, Value: value}}, nil
+}
+
+func (f *fakeKeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if _, found := f.values[key]; !found {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound}
+	}
+	delete(f.values, key)
+	return &client.Response{}, nil
+}
+
+func TestEtcdBackendAdd(t *testing.T) {
+	m := &Machine{Member: client.Member{
+		ID:         "1",
+		Name:       "foo",
+		PeerURLs:   []string{"http://1.2.3.4:2380"},
+		ClientURLs: []string{"https://1.2.3.4:4001"},
+	}}
+	rec := `{"clientURLs":["https://1.2.3.4:4001"]}`
+
+	tests := []struct {
+		name     string
+		values   map[string]string
+		err      error
+		added    bool
+		expected map[string]string
+		fails    bool
+	}{
+		{
+			name:   "new machine",
+			values: map[string]string{},
+			added:  true,
+			expected: map[string]string{
+				"/disc/1":       "foo=http://1.2.3.4:2380",
+				"/disc/_meta/1": rec,
+			},
+		},
+		{
+			name:   "already exists",
+			values: map[string]string{"/disc/1": "foo=http://1.2.3.4:2380"},
+			added:  false,
+			expected: map[string]string{
+				"/disc/1":       "foo=http://1.2.3.4:2380",
+				"/disc/_meta/1": rec,
+			},
+		},
+		{
+			name:     "etcd failure",
+			values:   map[string]string{},
+			err:      errors.New("unavailable"),
+			expected: map[string]string{},
+			fails:    true,
+		},
+	}
+
+	for _, test := range tests {
+		kapi := &fakeKeysAPI{values: test.values, err: test.err}
+		b := &etcdBackend{kapi: kapi, dir: "/disc", clientPort: 2379}
+		added, err := b.Add(context.Background(), m)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+		} else if err != nil || added != test.added {
+			t.Errorf("%s: expected added=%v, got %v, %v", test.name, test.added, added, err)
+		}
+		if !reflect.DeepEqual(kapi.values, test.expected) {
+			t.Errorf("%s: expected keys %v, got %v", test.name, test.expected, kapi.values)
+		}
+	}
+}
+
+func TestEtcdBackendDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   map[string]string
+		err      error
+		found    bool
+		expected map[string]string
+		fails    bool
+	}{
+		{
+			name: "existing machine",
+			values: map[string]string{
+				"/disc/1":       "foo=http://1.2.3.4:2380",
+				"/disc/_meta/1": `{}`,
+				"/disc/2":       "bar=http://1.2.3.5:2380",
+			},
+			found:    true,
+			expected: map[string]string{"/disc/2": "bar=http://1.2.3.5:2380"},
+		},
+		{
+			name:     "not found",
+			values:   map[string]string{"/disc/2": "bar=http://1.2.3.5:2380"},
+			found:    false,
+			expected: map[string]string{"/disc/2": "bar=http://1.2.3.5:2380"},
+		},
+		{
+			name:     "etcd failure",
+			values:   map[string]string{"/disc/1": "foo=http://1.2.3.4:2380"},
+			err:      errors.New("unavailable"),
+			expected: map[string]string{"/disc/1": "foo=http://1.2.3.4:2380"},
+			fails:    true,
+		},
+	}
+
+	for _, test := range tests {
+		kapi := &fakeKeysAPI{values: test.values, err: test.err}
+		b := &etcdBackend{kapi: kapi, dir: "/disc", clientPort: 2379}
+		found, err := b.Delete(context.Background(), "1")
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+		} else if err != nil || found != test.found {
+			t.Errorf("%s: expected found=%v, got %v, %v", test.name, test.found, found, err)
+		}
+		if !reflect.DeepEqual(kapi.values, test.expected) {
+			t.Errorf("%s: expected keys %v, got %v", test.name, test.expected, kapi.values)
+		}
+	}
+}
+
+func TestEtcdBackendMachines(t *testing.T) {
+	tests := []struct {
+		name       string
+		values     map[string]string
+		err        error
+		names      []string
+		clientURLs [][]string
+		fails      bool
+	}{
+		{
+			name:   "not found",
+			values: map[string]string{},
+		},
+		{
+			name: "machines with records",
+			values: map[string]string{
+				"/disc/_config/size": "3",
+				"/disc/1":            "foo=http://1.2.3.4:2380",
+				"/disc/_meta/1":      `{"clientURLs":["https://1.2.3.4:4001"]}`,
+				"/disc/2":            "bar=http://1.2.3.5:2380",
+				"/disc/3":            "invalid",
+			},
+			names:      []string{"foo", "bar"},
+			clientURLs: [][]string{{"https://1.2.3.4:4001"}, {"http://1.2.3.5:2379"}},
+		},
+		{
+			name:  "etcd failure",
+			err:   errors.New("unavailable"),
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		kapi := &fakeKeysAPI{values: test.values, err: test.err}
+		b := &etcdBackend{kapi: kapi, dir: "/disc", clientPort: 2379}
+		ms, err := b.Machines(context.Background())
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		var names []string
+		var clientURLs [][]string
+		for _, m := range ms {
+			names = append(names, m.Name)
+			clientURLs = append(clientURLs, m.ClientURLs)
+		}
+		if !reflect.DeepEqual(names, test.names) || !reflect.DeepEqual(clientURLs, test.clientURLs) {
+			t.Errorf("%s: expected machines %v with client urls %v, got %v with %v", test.name, test.names, test.clientURLs, names, clientURLs)
+		}
+	}
+}
@@ -1,19 +1,78 @@
 package discovery
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/coreos/etcd/client"
 )
 
+var (
+	// ErrNoName is returned for a machine value entry without name=url format.
+	ErrNoName = errors.New("missing name")
+
+	// ErrNamesDiffer is returned for a machine value with different names.
+	ErrNamesDiffer = errors.New("different names")
+
+	// ErrInvalidScheme is returned for peer urls with a scheme other than http or https.
+	ErrInvalidScheme = errors.New("peer url scheme must be http or https")
+
+	// ErrNoHost is returned for peer urls without host.
+	ErrNoHost = errors.New("peer url without host")
+)
+
+// ParseError describes an invalid discovery url machine value.
+type ParseError struct {
+	Value string
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid machine value %q: %v", e.Value, e.Err)
+}
+
+// recordDir is the hidden directory next to the machine values holding the records.
+const recordDir = "_meta"
+
+// Record is the extended information of a machine which does not fit into the
+// name=peerurl machine value. It is stored as JSON under _meta/<id> next to the value,
+// hidden for etcd and older elastic-etcd versions which only understand the value.
+type Record struct {
+	ClientURLs []string          `json:"clientURLs,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// ParseRecord parses the JSON representation of a Record.
+func ParseRecord(s string) (*Record, error) {
+	var rec Record
+	if err := json.Unmarshal([]byte(s), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// String returns the JSON representation of a Record.
+func (rec *Record) String() string {
+	bs, _ := json.Marshal(rec)
+	return string(bs)
+}
+
 // Machine represents a cluster member extracted from a discovery url.
 type Machine struct {
 	client.Member
+	Metadata map[string]string
 }
 
-// NewDiscoveryNode parses a discovery URL machine value into a Machine.
-func NewDiscoveryNode(namedPeerURLs string, clientPort int) (*Machine, error) {
+// NewDiscoveryNode parses a discovery URL machine value into a Machine. The client
+// urls are taken from the record if it has any. Otherwise, they are derived from the
+// peer urls and the client port.
+func NewDiscoveryNode(namedPeerURLs string, rec *Record, clientPort int) (*Machine, error) {
 	urls := strings.Split(namedPeerURLs, ",")
 	n := Machine{
 		Member: client.Member{
@@ -23,18 +82,72 @@ func NewDiscoveryNode(namedPeerURLs string, clientPort int) (*Machine, error) {
 	}
 	for _, namedPeerURL := range urls {
 		eqc := strings.SplitN(namedPeerURL, "=", 2)
+		if len(eqc) != 2 || eqc[0] == "" {
+			return nil, &ParseError{Value: namedPeerURLs, Err: ErrNoName}
+		}
 		if n.Name != "" && n.Name != eqc[0] {
-			return nil, fmt.Errorf("different names in %s", namedPeerURLs)
+			return nil, &ParseError{Value: namedPeerURLs, Err: ErrNamesDiffer}
 		}
 		n.Name = eqc[0]
-		colc := strings.SplitN(eqc[1], ":", 3)
+
+		clientURL, err := ClientURL(eqc[1], clientPort)
+		if err != nil {
+			return nil, &ParseError{Value: namedPeerURLs, Err: err}
+		}
 		n.PeerURLs = append(n.PeerURLs, eqc[1])
-		n.ClientURLs = append(n.ClientURLs, fmt.Sprintf("%s:%s:%d", colc[0], colc[1], clientPort))
+		n.ClientURLs = append(n.ClientURLs, clientURL)
+	}
+
+	if rec != nil {
+		if len(rec.ClientURLs) > 0 {
+			n.ClientURLs = rec.ClientURLs
+		}
+		n.Metadata = rec.Metadata
 	}
 
 	return &n, nil
 }
 
+// Record returns the extended record of a Machine, or nil if there are neither client
+// urls nor metadata.
+func (n *Machine) Record() *Record {
+	if len(n.ClientURLs) == 0 && len(n.Metadata) == 0 {
+		return nil
+	}
+	return &Record{
+		ClientURLs: n.ClientURLs,
+		Metadata:   n.Metadata,
+	}
+}
+
+// ClientURL derives a client url from a peer url by replacing the port.
+func ClientURL(peerURL string, clientPort int) (string, error) {
+	u, err := url.Parse(peerURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", ErrInvalidScheme
+	}
+	if u.Host == "" {
+		return "", ErrNoHost
+	}
+
+	host := u.Host
+	if h, _, err := net.SplitHostPort(u.Host); err == nil {
+		host = h
+	} else {
+		// no port, but maybe an IPv6 address in brackets
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+
+	cu := url.URL{
+		Scheme: u.Scheme,
+		Host:   net.JoinHostPort(host, strconv.Itoa(clientPort)),
+	}
+	return cu.String(), nil
+}
+
 // NamedPeerURLs returnes a slace of name=http://domain:port values for a Machine.
 func (n *Machine) NamedPeerURLs() []string {
 	us := make([]string, 0, len(n.PeerURLs))
@@ -0,0 +1,83 @@
+package discovery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewDiscoveryNode(t *testing.T) {
+	tests := []struct {
+		value      string
+		name       string
+		clientURLs []string
+		err        error
+	}{
+		{"foo=http://1.2.3.4:2380", "foo", []string{"http://1.2.3.4:2379"}, nil},
+		{"foo=https://1.2.3.4:2380", "foo", []string{"https://1.2.3.4:2379"}, nil},
+		{"foo=http://[fd00::1]:2380", "foo", []string{"http://[fd00::1]:2379"}, nil},
+		{"foo=https://[fd00::1]", "foo", []string{"https://[fd00::1]:2379"}, nil},
+		{"foo=http://etcd.example.com:2380", "foo", []string{"http://etcd.example.com:2379"}, nil},
+		{"foo=http://etcd.example.com", "foo", []string{"http://etcd.example.com:2379"}, nil},
+		{
+			"foo=http://1.2.3.4:2380,foo=https://[fd00::1]:2380", "foo",
+			[]string{"http://1.2.3.4:2379", "https://[fd00::1]:2379"}, nil,
+		},
+		{"http://1.2.3.4:2380", "", nil, ErrNoName},
+		{"", "", nil, ErrNoName},
+		{"=http://1.2.3.4:2380", "", nil, ErrNoName},
+		{"foo=http://1.2.3.4:2380,bar=http://1.2.3.5:2380", "", nil, ErrNamesDiffer},
+		{"foo=unix://1.2.3.4:2380", "", nil, ErrInvalidScheme},
+		{"foo=localhost:2380", "", nil, ErrInvalidScheme},
+		{"foo=http://", "", nil, ErrNoHost},
+	}
+
+	for _, test := range tests {
+		n, err := NewDiscoveryNode(test.value, nil, 2379)
+		if test.err != nil {
+			perr, ok := err.(*ParseError)
+			if !ok || perr.Err != test.err {
+				t.Errorf("%q: expected error %v, got %v", test.value, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.value, err)
+			continue
+		}
+		if n.Name != test.name {
+			t.Errorf("%q: expected name %q, got %q", test.value, test.name, n.Name)
+		}
+		if !reflect.DeepEqual(n.ClientURLs, test.clientURLs) {
+			t.Errorf("%q: expected client urls %v, got %v", test.value, test.clientURLs, n.ClientURLs)
+		}
+	}
+}
+
+func TestNewDiscoveryNodeWithRecord(t *testing.T) {
+	rec, err := ParseRecord(`{"clientURLs":["https://1.2.3.4:4001"],"metadata":{"zone":"a"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewDiscoveryNode("foo=http://1.2.3.4:2380", rec, 2379)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(n.ClientURLs, []string{"https://1.2.3.4:4001"}) {
+		t.Errorf("expected client urls from record, got %v", n.ClientURLs)
+	}
+	if n.Metadata["zone"] != "a" {
+		t.Errorf("expected metadata from record, got %v", n.Metadata)
+	}
+	if got := n.Record().String(); got != rec.String() {
+		t.Errorf("expected record %s, got %s", rec, got)
+	}
+
+	// legacy entry without client urls in the record
+	n, err = NewDiscoveryNode("foo=http://1.2.3.4:2380", &Record{}, 2379)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(n.ClientURLs, []string{"http://1.2.3.4:2379"}) {
+		t.Errorf("expected derived client urls, got %v", n.ClientURLs)
+	}
+}
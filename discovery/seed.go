@@ -0,0 +1,122 @@
+package discovery
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+type seedBackend struct {
+	endpoints []string
+	mapi      client.MembersAPI
+	mirror    Backend
+}
+
+// NewSeedBackend creates a Backend which lists the started members of an existing
+// cluster through the members API, using the endpoints of the given client config.
+// The cluster size and registrations are delegated to mirror if it is not nil. If no
+// endpoint is reachable, the machines of mirror are returned.
+func NewSeedBackend(cfg client.Config, mirror Backend) (Backend, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, fmt.Errorf("no seed endpoints given")
+	}
+	if cfg.HeaderTimeoutPerRequest == 0 {
+		cfg.HeaderTimeoutPerRequest = discoveryTimeout
+	}
+
+	c, err := client.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &seedBackend{
+		endpoints: cfg.Endpoints,
+		mapi:      client.NewMembersAPI(c),
+		mirror:    mirror,
+	}, nil
+}
+
+// String returns the seed endpoints.
+func (b *seedBackend) String() string {
+	return "seed endpoints " + strings.Join(b.endpoints, ",")
+}
+
+// DiscoveryURL returns the discovery url of the mirror, if it has one.
+func (b *seedBackend) DiscoveryURL() string {
+	if bs, ok := b.mirror.(Bootstrapper); ok {
+		return bs.DiscoveryURL()
+	}
+	return ""
+}
+
+// DiscoverySRV returns the SRV domain of the mirror, if it has one.
+func (b *seedBackend) DiscoverySRV() string {
+	if bs, ok := b.mirror.(SRVBootstrapper); ok {
+		return bs.DiscoverySRV()
+	}
+	return ""
+}
+
+// Machines returns the started members of the cluster behind the seed endpoints.
+func (b *seedBackend) Machines(ctx context.Context) ([]Machine, error) {
+	ctx, _ = context.WithTimeout(ctx, discoveryTimeout)
+
+	glog.V(6).Infof("Getting members from %s", b)
+	ms, err := b.mapi.List(ctx)
+	if err != nil {
+		if b.mirror == nil {
+			return nil, fmt.Errorf("no seed endpoint reachable: %v", err)
+		}
+		glog.Warningf("No seed endpoint reachable, falling back to discovery %v: %v", b.mirror, err)
+		return b.mirror.Machines(ctx)
+	}
+
+	nodes := make([]Machine, 0, len(ms))
+	for _, m := range ms {
+		if m.Name == "" || len(m.ClientURLs) == 0 {
+			glog.V(5).Infof("Skipping unstarted member %s=%v", m.ID, m.PeerURLs)
+			continue
+		}
+		nodes = append(nodes, Machine{Member: m})
+	}
+	return nodes, nil
+}
+
+// Size returns the cluster size of the mirror.
+func (b *seedBackend) Size(ctx context.Context) (int, error) {
+	if b.mirror == nil {
+		return 0, fmt.Errorf("seed endpoints do not define a cluster size, it must be given explicitly")
+	}
+	return b.mirror.Size(ctx)
+}
+
+// Add registers the Machine in the mirror. Failures are only logged because the
+// members of the cluster are the source of truth.
+func (b *seedBackend) Add(ctx context.Context, n *Machine) (bool, error) {
+	if b.mirror == nil {
+		return false, nil
+	}
+	added, err := b.mirror.Add(ctx, n)
+	if err != nil {
+		glog.Warningf("Failed to add %s to discovery %v: %v", n.Name, b.mirror, err)
+		return false, nil
+	}
+	return added, nil
+}
+
+// Delete deregisters the machine from the mirror. Failures are only logged because
+// the members of the cluster are the source of truth.
+func (b *seedBackend) Delete(ctx context.Context, id string) (bool, error) {
+	if b.mirror == nil {
+		return false, nil
+	}
+	found, err := b.mirror.Delete(ctx, id)
+	if err != nil {
+		glog.Warningf("Failed to delete %s from discovery %v: %v", id, b.mirror, err)
+		return false, nil
+	}
+	return found, nil
+}
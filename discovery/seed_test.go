@@ -0,0 +1,105 @@
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func TestNewSeedBackend(t *testing.T) {
+	tests := []struct {
+		endpoints []string
+		fails     bool
+	}{
+		{nil, true},
+		{[]string{"://1.2.3.4:2379"}, true},
+		{[]string{"http://1.2.3.4:2379"}, false},
+		{[]string{"http://1.2.3.4:2379", "https://1.2.3.5:2379"}, false},
+	}
+
+	for _, test := range tests {
+		b, err := NewSeedBackend(client.Config{Endpoints: test.endpoints}, nil)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%v: expected error", test.endpoints)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.endpoints, err)
+			continue
+		}
+		if expected := "seed endpoints " + strings.Join(test.endpoints, ","); fmt.Sprint(b) != expected {
+			t.Errorf("%v: expected %q, got %q", test.endpoints, expected, fmt.Sprint(b))
+		}
+	}
+}
+
+func TestSeedBackendMachines(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/members" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"members":[
+			{"id":"1","name":"foo","peerURLs":["http://1.2.3.4:2380"],"clientURLs":["http://1.2.3.4:2379"]},
+			{"id":"2","name":"","peerURLs":["http://1.2.3.5:2380"],"clientURLs":[]},
+			{"id":"3","name":"bar","peerURLs":["http://1.2.3.6:2380"],"clientURLs":["http://1.2.3.6:2379"]}
+		]}`)
+	}))
+	defer ts.Close()
+
+	// a closed server as unreachable seed
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	mirror := &etcdBackend{
+		kapi:       &fakeKeysAPI{values: map[string]string{"/disc/9": "baz=http://1.2.3.9:2380"}},
+		dir:        "/disc",
+		clientPort: 2379,
+	}
+
+	tests := []struct {
+		name     string
+		endpoint string
+		mirror   Backend
+		names    []string
+		fails    bool
+	}{
+		{"started members", ts.URL, nil, []string{"foo", "bar"}, false},
+		{"unreachable seed", closed.URL, nil, nil, true},
+		{"unreachable seed with mirror", closed.URL, mirror, []string{"baz"}, false},
+	}
+
+	for _, test := range tests {
+		b, err := NewSeedBackend(client.Config{Endpoints: []string{test.endpoint}}, test.mirror)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ms, err := b.Machines(context.Background())
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		var names []string
+		for _, m := range ms {
+			names = append(names, m.Name)
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%s: expected machines %v, got %v", test.name, test.names, names)
+		}
+	}
+}
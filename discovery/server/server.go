@@ -0,0 +1,151 @@
+// Package server implements a discovery service compatible with the discovery.etcd.io
+// protocol, i.e. with the subset of the etcd v2 keys API used by etcd and elastic-etcd.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/store"
+	"github.com/golang/glog"
+)
+
+const defaultSize = 3
+
+// Server serves discovery tokens from a Store.
+type Server struct {
+	store        *Store
+	advertiseURL string
+}
+
+// New creates a discovery Server. New token urls are prefixed with advertiseURL, or
+// with the scheme and host of the request if advertiseURL is empty.
+func New(s *Store, advertiseURL string) *Server {
+	return &Server{
+		store:        s,
+		advertiseURL: strings.TrimRight(advertiseURL, "/"),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	glog.V(6).Infof("%s %s", r.Method, r.URL)
+
+	p := strings.Trim(r.URL.Path, "/")
+	if p == "new" {
+		s.newToken(w, r)
+		return
+	}
+	if p == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	parts := strings.SplitN(p, "/", 2)
+	id, key := parts[0], ""
+	if len(parts) > 1 {
+		key = strings.Trim(parts[1], "/")
+	}
+
+	var (
+		ev  *store.Event
+		err error
+	)
+	switch r.Method {
+	case "GET":
+		recursive := r.FormValue("recursive") == "true"
+		if r.FormValue("wait") == "true" {
+			var waitIndex uint64
+			if wi := r.FormValue("waitIndex"); wi != "" {
+				waitIndex, err = strconv.ParseUint(wi, 10, 64)
+				if err != nil {
+					etcdErr.NewRequestError(etcdErr.EcodeIndexNaN, `invalid value for "waitIndex"`).WriteTo(w)
+					return
+				}
+			}
+			ev, err = s.store.Watch(r.Context(), id, key, recursive, waitIndex)
+		} else {
+			ev, err = s.store.Get(id, key, recursive)
+		}
+	case "PUT":
+		var prevExist *bool
+		if pe := r.FormValue("prevExist"); pe != "" {
+			b, perr := strconv.ParseBool(pe)
+			if perr != nil {
+				etcdErr.NewRequestError(etcdErr.EcodeInvalidField, `invalid value for "prevExist"`).WriteTo(w)
+				return
+			}
+			prevExist = &b
+		}
+		ev, err = s.store.Set(id, key, r.FormValue("value"), prevExist)
+	case "DELETE":
+		ev, err = s.store.Delete(id, key)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", fmt.Sprint(s.store.Index()))
+	if ev.IsCreated() {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(ev); err != nil {
+		glog.Warningf("Failed to write response for %s %s: %v", r.Method, r.URL, err)
+	}
+}
+
+func (s *Server) newToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" {
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	size := defaultSize
+	if v := r.FormValue("size"); v != "" {
+		var err error
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 1 {
+			http.Error(w, fmt.Sprintf("invalid size %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	id, err := s.store.NewToken(size)
+	if err != nil {
+		glog.Errorf("Failed to create discovery token: %v", err)
+		http.Error(w, "unable to create token", http.StatusInternalServerError)
+		return
+	}
+
+	base := s.advertiseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	glog.Infof("Created discovery token %s for a cluster of size %d", id, size)
+	fmt.Fprintf(w, "%s/%s", base, id)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*etcdErr.Error); ok {
+		e.WriteTo(w)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
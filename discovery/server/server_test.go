@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/sttts/elastic-etcd/discovery"
+	"golang.org/x/net/context"
+)
+
+func newToken(t *testing.T, url string, size int) string {
+	resp, err := http.Get(fmt.Sprintf("%s/new?size=%d", url, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code %d on /new: %s", resp.StatusCode, body)
+	}
+	if !strings.HasPrefix(string(body), url+"/") {
+		t.Fatalf("unexpected token url %q", body)
+	}
+	return string(body)
+}
+
+func TestHTTPBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	dataFile := filepath.Join(dir, "discovery.json")
+
+	s, err := NewStore(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(New(s, ""))
+	defer ts.Close()
+
+	ctx := context.Background()
+	b, err := discovery.NewHTTPBackend(newToken(t, ts.URL, 3), discovery.Config{ClientPort: 2379})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size, err := b.Size(ctx); err != nil || size != 3 {
+		t.Fatalf("expected size 3, got %d, %v", size, err)
+	}
+	if ms, err := b.Machines(ctx); err != nil || len(ms) != 0 {
+		t.Fatalf("expected no machines, got %v, %v", ms, err)
+	}
+
+	m := &discovery.Machine{Member: client.Member{
+		ID:         "abc",
+		Name:       "foo",
+		PeerURLs:   []string{"http://1.2.3.4:2380"},
+		ClientURLs: []string{"http://1.2.3.4:4001"},
+	}}
+	if added, err := b.Add(ctx, m); err != nil || !added {
+		t.Fatalf("expected machine to be added, got %v, %v", added, err)
+	}
+	if added, err := b.Add(ctx, m); err != nil || added {
+		t.Fatalf("expected machine to exist already, got %v, %v", added, err)
+	}
+
+	// reload store from disk
+	s, err = NewStore(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Config.Handler = New(s, "")
+
+	ms, err := b.Machines(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || ms[0].Name != "foo" || ms[0].ClientURLs[0] != "http://1.2.3.4:4001" {
+		t.Fatalf("unexpected machines %v", ms)
+	}
+
+	if found, err := b.Delete(ctx, "abc"); err != nil || !found {
+		t.Fatalf("expected machine to be deleted, got %v, %v", found, err)
+	}
+	if found, err := b.Delete(ctx, "abc"); err != nil || found {
+		t.Fatalf("expected machine to be gone, got %v, %v", found, err)
+	}
+}
+
+func TestKeysAPI(t *testing.T) {
+	s, err := NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(New(s, ""))
+	defer ts.Close()
+
+	token := strings.TrimPrefix(newToken(t, ts.URL, 3), ts.URL)
+	c, err := client.New(client.Config{Endpoints: []string{ts.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPIWithPrefix(c, "")
+	ctx := context.Background()
+
+	resp, err := kapi.Get(ctx, token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Node.Dir || len(resp.Node.Nodes) != 0 {
+		t.Fatalf("expected empty token directory, got %v", resp.Node)
+	}
+
+	w := kapi.Watcher(token, &client.WatcherOptions{AfterIndex: resp.Index, Recursive: true})
+	watched := make(chan *client.Response, 1)
+	go func() {
+		resp, err := w.Next(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		watched <- resp
+	}()
+
+	if _, err := kapi.Create(ctx, token+"/1", "foo=http://1.2.3.4:2380"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = kapi.Create(ctx, token+"/1", "foo=http://1.2.3.4:2380")
+	if cerr, ok := err.(client.Error); !ok || cerr.Code != client.ErrorCodeNodeExist {
+		t.Fatalf("expected node exists error, got %v", err)
+	}
+
+	select {
+	case resp := <-watched:
+		if resp == nil || resp.Action != "create" || resp.Node.Key != token+"/1" {
+			t.Fatalf("unexpected watch event %v", resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for watch event")
+	}
+}
+
+func TestWatchHidden(t *testing.T) {
+	s, err := NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.NewToken(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := s.Index()
+
+	if _, err := s.Set(id, "_config/foo", "bar", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set(id, "1", "foo=http://1.2.3.4:2380", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ev, err := s.Watch(ctx, id, "", true, index+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Node.Key != nodePath(id, "1") {
+		t.Errorf("expected recursive watch to skip hidden keys, got event for %s", ev.Node.Key)
+	}
+
+	ev, err = s.Watch(ctx, id, "_config/foo", false, index+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Node.Key != nodePath(id, "_config/foo") {
+		t.Errorf("expected watch of a hidden key to see it, got event for %s", ev.Node.Key)
+	}
+}
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/store"
+	"golang.org/x/net/context"
+)
+
+const (
+	maxHistory = 1000
+	sizeKey    = "_config/size"
+)
+
+type entry struct {
+	Value         string `json:"value"`
+	CreatedIndex  uint64 `json:"createdIndex"`
+	ModifiedIndex uint64 `json:"modifiedIndex"`
+}
+
+type token struct {
+	CreatedIndex uint64            `json:"createdIndex"`
+	Entries      map[string]*entry `json:"entries"`
+}
+
+type storeData struct {
+	Index  uint64            `json:"index"`
+	Tokens map[string]*token `json:"tokens"`
+}
+
+type historyEvent struct {
+	token string
+	key   string
+	event *store.Event
+}
+
+// Store is a key-value store for discovery tokens, persisted to a file.
+type Store struct {
+	path string
+
+	lock    sync.Mutex
+	data    storeData
+	history []historyEvent
+	changed chan struct{}
+}
+
+// NewStore creates a Store persisted to the given file. The file is read if it exists.
+// With an empty path the store is kept in memory only.
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		data: storeData{
+			Tokens: map[string]*token{},
+		},
+		changed: make(chan struct{}),
+	}
+
+	if path != "" && fileutil.Exist(path) {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(bs, &s.data); err != nil {
+			return nil, err
+		}
+		if s.data.Tokens == nil {
+			s.data.Tokens = map[string]*token{}
+		}
+	}
+
+	return s, nil
+}
+
+// NewToken creates a new discovery token for a cluster of the given size.
+func (s *Store) NewToken(size int) (string, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(bs)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.data.Index++
+	s.data.Tokens[id] = &token{
+		CreatedIndex: s.data.Index,
+		Entries: map[string]*entry{
+			sizeKey: {
+				Value:         strconv.Itoa(size),
+				CreatedIndex:  s.data.Index,
+				ModifiedIndex: s.data.Index,
+			},
+		},
+	}
+
+	return id, s.save()
+}
+
+// Index returns the current index of the store.
+func (s *Store) Index() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.data.Index
+}
+
+// Get returns the value or directory listing of a key below a token.
+func (s *Store) Get(id, key string, recursive bool) (*store.Event, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, err := s.token(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if e, found := t.Entries[key]; found {
+		return &store.Event{
+			Action:    "get",
+			Node:      e.extern(id, key),
+			EtcdIndex: s.data.Index,
+		}, nil
+	}
+
+	n, found := t.dir(id, key, recursive)
+	if !found {
+		return nil, etcdErr.NewError(etcdErr.EcodeKeyNotFound, nodePath(id, key), s.data.Index)
+	}
+	return &store.Event{
+		Action:    "get",
+		Node:      n,
+		EtcdIndex: s.data.Index,
+	}, nil
+}
+
+// Set stores a value below a token. If prevExist is not nil, the key must or must not
+// exist before.
+func (s *Store) Set(id, key, value string, prevExist *bool) (*store.Event, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, err := s.token(id)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, etcdErr.NewError(etcdErr.EcodeNotFile, nodePath(id, key), s.data.Index)
+	}
+	if _, found := t.dir(id, key, false); found {
+		return nil, etcdErr.NewError(etcdErr.EcodeNotFile, nodePath(id, key), s.data.Index)
+	}
+
+	prev, found := t.Entries[key]
+	if prevExist != nil && *prevExist && !found {
+		return nil, etcdErr.NewError(etcdErr.EcodeKeyNotFound, nodePath(id, key), s.data.Index)
+	}
+	if prevExist != nil && !*prevExist && found {
+		return nil, etcdErr.NewError(etcdErr.EcodeNodeExist, nodePath(id, key), s.data.Index)
+	}
+
+	s.data.Index++
+	e := &entry{
+		Value:         value,
+		CreatedIndex:  s.data.Index,
+		ModifiedIndex: s.data.Index,
+	}
+	ev := &store.Event{
+		Action:    "set",
+		EtcdIndex: s.data.Index,
+	}
+	if found {
+		e.CreatedIndex = prev.CreatedIndex
+		ev.PrevNode = prev.extern(id, key)
+		if prevExist != nil {
+			ev.Action = "update"
+		}
+	} else if prevExist != nil {
+		ev.Action = "create"
+	}
+	t.Entries[key] = e
+	ev.Node = e.extern(id, key)
+
+	return ev, s.commit(id, key, ev)
+}
+
+// Delete removes a key below a token.
+func (s *Store) Delete(id, key string) (*store.Event, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, err := s.token(id)
+	if err != nil {
+		return nil, err
+	}
+	prev, found := t.Entries[key]
+	if !found {
+		return nil, etcdErr.NewError(etcdErr.EcodeKeyNotFound, nodePath(id, key), s.data.Index)
+	}
+
+	s.data.Index++
+	delete(t.Entries, key)
+	ev := &store.Event{
+		Action: "delete",
+		Node: &store.NodeExtern{
+			Key:           nodePath(id, key),
+			CreatedIndex:  prev.CreatedIndex,
+			ModifiedIndex: s.data.Index,
+		},
+		PrevNode:  prev.extern(id, key),
+		EtcdIndex: s.data.Index,
+	}
+
+	return ev, s.commit(id, key, ev)
+}
+
+// Watch waits for the first change of a key below a token with an index of at least
+// waitIndex. A zero waitIndex waits for the next change.
+func (s *Store) Watch(ctx context.Context, id, key string, recursive bool, waitIndex uint64) (*store.Event, error) {
+	for {
+		s.lock.Lock()
+		if _, err := s.token(id); err != nil {
+			s.lock.Unlock()
+			return nil, err
+		}
+		if waitIndex == 0 {
+			waitIndex = s.data.Index + 1
+		}
+		if waitIndex <= s.data.Index {
+			oldest := s.data.Index + 1
+			if len(s.history) > 0 {
+				oldest = s.history[0].event.Index()
+			}
+			if waitIndex < oldest {
+				err := etcdErr.NewError(etcdErr.EcodeEventIndexCleared, "", s.data.Index)
+				s.lock.Unlock()
+				return nil, err
+			}
+		}
+		for _, h := range s.history {
+			if h.event.Index() < waitIndex || h.token != id {
+				continue
+			}
+			if h.key == key || (recursive && below(h.key, key)) {
+				s.lock.Unlock()
+				return h.event, nil
+			}
+		}
+		changed := s.changed
+		s.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// below returns true if k is below the directory key and not hidden by a path component
+// starting with an underscore, as recursive watches in etcd skip hidden keys.
+func below(k, key string) bool {
+	rest := k
+	if key != "" {
+		if !strings.HasPrefix(k, key+"/") {
+			return false
+		}
+		rest = strings.TrimPrefix(k, key+"/")
+	}
+	for _, c := range strings.Split(rest, "/") {
+		if strings.HasPrefix(c, "_") {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) token(id string) (*token, error) {
+	t, found := s.data.Tokens[id]
+	if !found {
+		return nil, etcdErr.NewError(etcdErr.EcodeKeyNotFound, nodePath(id, ""), s.data.Index)
+	}
+	return t, nil
+}
+
+func (s *Store) commit(id, key string, ev *store.Event) error {
+	s.history = append(s.history, historyEvent{token: id, key: key, event: ev})
+	if len(s.history) > maxHistory {
+		s.history = s.history[len(s.history)-maxHistory:]
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	return s.save()
+}
+
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	bs, err := json.MarshalIndent(&s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (e *entry) extern(id, key string) *store.NodeExtern {
+	v := e.Value
+	return &store.NodeExtern{
+		Key:           nodePath(id, key),
+		Value:         &v,
+		CreatedIndex:  e.CreatedIndex,
+		ModifiedIndex: e.ModifiedIndex,
+	}
+}
+
+// dir returns the directory node of key, hiding children starting with an underscore
+// like etcd does.
+func (t *token) dir(id, key string, recursive bool) (*store.NodeExtern, bool) {
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
+	}
+
+	d := &store.NodeExtern{
+		Key:           nodePath(id, key),
+		Dir:           true,
+		CreatedIndex:  t.CreatedIndex,
+		ModifiedIndex: t.CreatedIndex,
+	}
+	found := key == ""
+	subdirs := map[string]bool{}
+	for k, e := range t.Entries {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		found = true
+
+		rest := strings.TrimPrefix(k, prefix)
+		child := strings.SplitN(rest, "/", 2)[0]
+		if strings.HasPrefix(child, "_") {
+			continue
+		}
+		if child == rest {
+			d.Nodes = append(d.Nodes, e.extern(id, k))
+			continue
+		}
+		if subdirs[child] {
+			continue
+		}
+		subdirs[child] = true
+		n, _ := t.dir(id, path.Join(key, child), recursive)
+		if !recursive {
+			n.Nodes = nil
+		}
+		d.Nodes = append(d.Nodes, n)
+	}
+	sort.Sort(d.Nodes)
+
+	return d, found
+}
+
+func nodePath(id, key string) string {
+	return path.Join("/", id, key)
+}
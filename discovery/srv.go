@@ -0,0 +1,126 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+var (
+	// indirection for testing
+	lookupSRV = net.LookupSRV
+)
+
+func init() {
+	RegisterBackend("srv", func(discoveryURL string, cfg Config) (Backend, error) {
+		return NewSRVBackend(discoveryURL, cfg)
+	}, "srv")
+}
+
+// SRVBootstrapper is implemented by backends which etcd itself can use with its
+// -discovery-srv flag to bootstrap a new cluster.
+type SRVBootstrapper interface {
+	// DiscoverySRV returns the value for etcd's -discovery-srv flag.
+	DiscoverySRV() string
+}
+
+type srvBackend struct {
+	domain     string
+	clientPort int
+}
+
+// NewSRVBackend creates a read-only Backend which derives the machines from the
+// _etcd-server-ssl._tcp and _etcd-server._tcp SRV records of a domain. The domain
+// is given as srv://domain or as plain domain name.
+func NewSRVBackend(discoveryURL string, cfg Config) (Backend, error) {
+	domain := discoveryURL
+	if strings.Contains(discoveryURL, "://") {
+		u, err := url.Parse(discoveryURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid discovery url %q: %v", discoveryURL, err)
+		}
+		if u.Scheme != "srv" {
+			return nil, fmt.Errorf("discovery url %q must use srv scheme", discoveryURL)
+		}
+		domain = u.Host
+	}
+	if domain == "" {
+		return nil, fmt.Errorf("no domain in discovery url %q", discoveryURL)
+	}
+
+	return &srvBackend{
+		domain:     domain,
+		clientPort: cfg.ClientPort,
+	}, nil
+}
+
+// String returns the domain as srv url.
+func (b *srvBackend) String() string {
+	return "srv://" + b.domain
+}
+
+// DiscoverySRV returns the domain of the SRV records.
+func (b *srvBackend) DiscoverySRV() string {
+	return b.domain
+}
+
+// Machines returns one machine per SRV record, named by the target host. It follows the
+// service to scheme mapping of etcd's own SRV discovery. The discoverer of the etcd client
+// cannot be reused because it only looks up the etcd-client services and keeps the
+// trailing dot of the targets.
+func (b *srvBackend) Machines(ctx context.Context) ([]Machine, error) {
+	nodes := []Machine{}
+
+	lookup := func(service, scheme string) error {
+		glog.V(6).Infof("Looking up SRV records _%s._tcp.%s", service, b.domain)
+		_, addrs, err := lookupSRV(service, "tcp", b.domain)
+		if err != nil {
+			return err
+		}
+		for _, srv := range addrs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			peerURL := url.URL{
+				Scheme: scheme,
+				Host:   net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+			}
+			n, err := NewDiscoveryNode(fmt.Sprintf("%s=%s", host, peerURL.String()), nil, b.clientPort)
+			if err != nil {
+				glog.Warningf("invalid SRV record %s:%d for %s: %v", srv.Target, srv.Port, b.domain, err)
+				continue
+			}
+			nodes = append(nodes, *n)
+		}
+		return nil
+	}
+
+	errHTTPS := lookup("etcd-server-ssl", "https")
+	errHTTP := lookup("etcd-server", "http")
+	if errHTTPS != nil && errHTTP != nil {
+		return nil, fmt.Errorf("dns lookup errors: %s and %s", errHTTPS, errHTTP)
+	}
+
+	return nodes, nil
+}
+
+// Size fails because SRV records do not carry a cluster size.
+func (b *srvBackend) Size(ctx context.Context) (int, error) {
+	return 0, errors.New("SRV records do not define a cluster size, it must be given explicitly")
+}
+
+// Add does nothing because SRV records are maintained outside of elastic-etcd.
+func (b *srvBackend) Add(ctx context.Context, n *Machine) (bool, error) {
+	glog.V(4).Infof("Not adding %s to %s, SRV records are read-only", n.Name, b)
+	return false, nil
+}
+
+// Delete does nothing because SRV records are maintained outside of elastic-etcd.
+func (b *srvBackend) Delete(ctx context.Context, id string) (bool, error) {
+	glog.V(4).Infof("Not deleting %s from %s, SRV records are read-only", id, b)
+	return false, nil
+}
@@ -0,0 +1,157 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestSRVBackend(t *testing.T) {
+	defer func(f func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = f }(lookupSRV)
+
+	// a local stand-in for the DNS server
+	records := map[string][]*net.SRV{
+		"_etcd-server-ssl._tcp.example.com": {
+			{Target: "infra0.example.com.", Port: 2380},
+			{Target: "infra1.example.com.", Port: 2480},
+		},
+		"_etcd-server._tcp.example.com": {
+			{Target: "10.0.0.3", Port: 2380},
+		},
+	}
+	lookupSRV = func(service, proto, domain string) (string, []*net.SRV, error) {
+		name := fmt.Sprintf("_%s._%s.%s", service, proto, domain)
+		addrs, found := records[name]
+		if !found {
+			return "", nil, &net.DNSError{Err: "no such host", Name: name}
+		}
+		return name, addrs, nil
+	}
+
+	ctx := context.Background()
+
+	b, err := NewBackend("", "srv://example.com", Config{ClientPort: 2379})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := b.Machines(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type machine struct {
+		name       string
+		peerURLs   []string
+		clientURLs []string
+	}
+	got := []machine{}
+	for _, m := range ms {
+		got = append(got, machine{m.Name, m.PeerURLs, m.ClientURLs})
+	}
+	expected := []machine{
+		{"infra0.example.com", []string{"https://infra0.example.com:2380"}, []string{"https://infra0.example.com:2379"}},
+		{"infra1.example.com", []string{"https://infra1.example.com:2480"}, []string{"https://infra1.example.com:2379"}},
+		{"10.0.0.3", []string{"http://10.0.0.3:2380"}, []string{"http://10.0.0.3:2379"}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected machines %v, got %v", expected, got)
+	}
+
+	if _, err := b.Size(ctx); err == nil {
+		t.Errorf("expected error for the size of SRV records")
+	}
+	if bs, ok := b.(SRVBootstrapper); !ok || bs.DiscoverySRV() != "example.com" {
+		t.Errorf("expected SRV bootstrapper for example.com")
+	}
+
+	b, err = NewBackend("srv", "example.org", Config{ClientPort: 2379})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Machines(ctx); err == nil {
+		t.Errorf("expected lookup error for example.org")
+	}
+}
+
+func TestSRVBackendServices(t *testing.T) {
+	defer func(f func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = f }(lookupSRV)
+
+	tests := []struct {
+		name     string
+		records  map[string][]*net.SRV
+		peerURLs []string
+		fails    bool
+	}{
+		{
+			name: "https only",
+			records: map[string][]*net.SRV{
+				"_etcd-server-ssl._tcp.example.com": {{Target: "infra0.example.com.", Port: 2380}},
+			},
+			peerURLs: []string{"https://infra0.example.com:2380"},
+		},
+		{
+			name: "http only",
+			records: map[string][]*net.SRV{
+				"_etcd-server._tcp.example.com": {{Target: "infra0.example.com.", Port: 2380}},
+			},
+			peerURLs: []string{"http://infra0.example.com:2380"},
+		},
+		{
+			name: "both",
+			records: map[string][]*net.SRV{
+				"_etcd-server-ssl._tcp.example.com": {{Target: "infra0.example.com.", Port: 2380}},
+				"_etcd-server._tcp.example.com":     {{Target: "infra1.example.com", Port: 2380}},
+			},
+			peerURLs: []string{"https://infra0.example.com:2380", "http://infra1.example.com:2380"},
+		},
+		{
+			name: "client services are ignored",
+			records: map[string][]*net.SRV{
+				"_etcd-client._tcp.example.com": {{Target: "infra0.example.com.", Port: 2379}},
+			},
+			fails: true,
+		},
+		{
+			name:  "none",
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		records := test.records
+		lookupSRV = func(service, proto, domain string) (string, []*net.SRV, error) {
+			name := fmt.Sprintf("_%s._%s.%s", service, proto, domain)
+			addrs, found := records[name]
+			if !found {
+				return "", nil, &net.DNSError{Err: "no such host", Name: name}
+			}
+			return name, addrs, nil
+		}
+
+		b, err := NewSRVBackend("example.com", Config{ClientPort: 2379})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ms, err := b.Machines(context.Background())
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		var peerURLs []string
+		for _, m := range ms {
+			peerURLs = append(peerURLs, m.PeerURLs...)
+		}
+		if !reflect.DeepEqual(peerURLs, test.peerURLs) {
+			t.Errorf("%s: expected peer urls %v, got %v", test.name, test.peerURLs, peerURLs)
+		}
+	}
+}
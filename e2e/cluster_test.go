@@ -5,18 +5,44 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/coreos/etcd/pkg/fileutil"
 	"github.com/coreos/gexpect"
 	"github.com/fatih/color"
+	"github.com/sttts/elastic-etcd/discovery/server"
 	elastic "github.com/sttts/elastic-etcd/pkg/elastic-etcd"
 )
 
+var (
+	discoveryServerOnce sync.Once
+	discoveryServer     *httptest.Server
+	discoveryServerErr  error
+)
+
+// localDiscoveryServer returns the url of an in-process discovery service, started on
+// first use, such that the tests do not depend on discovery.etcd.io.
+func localDiscoveryServer() (string, error) {
+	discoveryServerOnce.Do(func() {
+		var s *server.Store
+		s, discoveryServerErr = server.NewStore("")
+		if discoveryServerErr != nil {
+			return
+		}
+		discoveryServer = httptest.NewServer(server.New(s, ""))
+	})
+	if discoveryServerErr != nil {
+		return "", discoveryServerErr
+	}
+	return discoveryServer.URL, nil
+}
+
 type etcdProcessCluster struct {
 	cfg   *elasticEtcdClusterConfig
 	procs []*etcdProcess
@@ -96,7 +122,11 @@ func (c *elasticEtcdProcessConfig) etcdProcessConfig() (*etcdProcessConfig, erro
 
 func (cc *elasticEtcdClusterConfig) etcdProcessConfigs() ([]*etcdProcessConfig, error) {
 	// get new discovery token
-	resp, err := http.Get(fmt.Sprintf("https://discovery.etcd.io/new?size=%d", cc.discoveryClusterSize))
+	serverURL, err := localDiscoveryServer()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Get(fmt.Sprintf("%s/new?size=%d", serverURL, cc.discoveryClusterSize))
 	if err != nil {
 		return nil, err
 	}
@@ -1,8 +1,8 @@
 package join
 
 import (
-	"errors"
 	"fmt"
+	"time"
 
 	"github.com/coreos/etcd/client"
 	"github.com/golang/glog"
@@ -11,42 +11,59 @@ import (
 )
 
 type memberAdder struct {
-	mapi         client.MembersAPI
-	activeNodes  []discovery.Machine
-	strategy     Strategy
-	clientPort   int
-	targetSize   int
-	discoveryURL string
+	mapi              client.MembersAPI
+	activeNodes       []discovery.Machine
+	strategy          Strategy
+	clientPort        int
+	targetSize        int
+	maxRemovals       int
+	minFaultTolerance int
+	fresh             bool
+	backend           discovery.Backend
+	cc                ClientConfig
+	dead              *deadTracker
+	lock              *joinLock
+	journal           *journal
+	report            *Report
+
+	attempts      int
+	retryInterval time.Duration
 }
 
+// newMemberAdder returns a memberAdder configured by the options. The targetSize is the
+// resolved cluster size. With a non-nil report, it runs dry.
 func newMemberAdder(
-	activeNodes []discovery.Machine,
-	strategy Strategy,
-	clientPort int,
+	opts Options,
 	targetSize int,
-	discoveryURL string,
+	mapi client.MembersAPI,
+	kapi client.KeysAPI,
+	backend discovery.Backend,
+	activeNodes []discovery.Machine,
+	report *Report,
 ) (*memberAdder, error) {
-	activeURLs := make([]string, 0, len(activeNodes))
-	for _, an := range activeNodes {
-		activeURLs = append(activeURLs, an.ClientURLs...)
-	}
-
-	c, err := client.New(client.Config{
-		Endpoints:               activeURLs,
-		Transport:               client.DefaultTransport,
-		HeaderTimeoutPerRequest: etcdTimeout,
-	})
+	dryRun := report != nil
+	lock, err := newJoinLock(kapi, opts.JoinLockTTL, opts.Name, dryRun, report)
 	if err != nil {
 		return nil, err
 	}
-
 	return &memberAdder{
-		mapi:         client.NewMembersAPI(c),
-		activeNodes:  activeNodes,
-		strategy:     strategy,
-		clientPort:   clientPort,
-		targetSize:   targetSize,
-		discoveryURL: discoveryURL,
+		mapi:              mapi,
+		activeNodes:       activeNodes,
+		strategy:          opts.Strategy,
+		clientPort:        opts.ClientPort,
+		targetSize:        targetSize,
+		maxRemovals:       opts.MaxRemovals,
+		minFaultTolerance: opts.MinFaultTolerance,
+		fresh:             opts.Fresh,
+		backend:           backend,
+		cc:                opts.Client,
+		dead:              newDeadTracker(kapi, opts, dryRun),
+		lock:              lock,
+		journal:           &journal{path: opts.JournalPath, dryRun: dryRun},
+		report:            report,
+
+		attempts:      mutationAttempts,
+		retryInterval: mutationRetryInterval,
 	}, nil
 }
 
@@ -78,171 +95,516 @@ findUnstartedMember:
 	return nil
 }
 
-func (ma *memberAdder) removeDeadMembersN(
-	ctx context.Context,
-	members []client.Member,
-	maxNum int,
-) ([]*client.Member, error) {
-	deleted := []*client.Member{}
-searchForDead:
-	for _, m := range members {
-		if len(deleted) >= maxNum {
-			break
-		}
-
-		for _, u := range m.PeerURLs {
-			n, err := discovery.NewDiscoveryNode(fmt.Sprintf("%s=%s", m.Name, u), ma.clientPort)
-			if err != nil {
-				glog.Warningf("Invalid peer URL %s in member %s found", u, m.Name)
-				continue searchForDead
-			}
-			if alive(ctx, n.Member) {
-				isActive, err := active(ctx, n.Member)
-				if err != nil {
-					glog.Warningf("Error checking member %s health", m.Name)
-					continue searchForDead
-				}
-				if isActive {
-					glog.V(5).Infof("Member %v found to be alive and active", n.NamedPeerURLs())
-					continue searchForDead
-				}
+// clientURLs returns the client urls to check a peer url of the member with. Started
+// members report their client urls in the members API. For other members, the client
+// urls published in the discovery service are used. For legacy discovery entries, they
+// are derived from the peer url and the client port.
+func (ma *memberAdder) clientURLs(m client.Member, peerURL string) ([]string, error) {
+	if len(m.ClientURLs) > 0 {
+		return m.ClientURLs, nil
+	}
+	for _, n := range ma.activeNodes {
+		for _, u := range n.PeerURLs {
+			if u == peerURL && len(n.ClientURLs) > 0 {
+				return n.ClientURLs, nil
 			}
 		}
+	}
+	cu, err := discovery.ClientURL(peerURL, ma.clientPort)
+	if err != nil {
+		return nil, err
+	}
+	return []string{cu}, nil
+}
 
-		glog.V(4).Infof("Trying to remove dead member %s=%v", m.Name, m.PeerURLs)
-		err := ma.mapi.Remove(ctx, m.ID)
-		if err != nil {
-			return nil, fmt.Errorf("couldn't remove dead member %s=%v: %v", m.Name, m.PeerURLs, err)
-		}
-		glog.Infof("Removed dead member %s=%q", m.Name, m.PeerURLs)
-
-		glog.V(4).Infof("Trying to remove dead member %s=%v from discovery url %v", m.Name, m.PeerURLs, ma.discoveryURL)
-		found, err := discovery.Delete(ctx, ma.discoveryURL, m.ID)
+// observeMember probes every peer url of the member.
+func (ma *memberAdder) observeMember(ctx context.Context, m client.Member) []Observation {
+	observations := []Observation{}
+	for _, u := range m.PeerURLs {
+		cus, err := ma.clientURLs(m, u)
 		if err != nil {
-			return nil, fmt.Errorf("could remove dead member %s=%v from discovery url %v: %v", m.Name, m.PeerURLs, ma.discoveryURL, err)
+			glog.Warningf("Invalid peer URL %s in member %s found: %v", u, m.Name, err)
+			observations = append(observations, Observation{
+				Name:     m.Name,
+				ID:       m.ID,
+				PeerURLs: []string{u},
+				Error:    fmt.Sprintf("invalid peer url: %v", err),
+			})
+			continue
 		}
-		if !found {
-			glog.V(2).Infof("Dead member %s=%q not found in discovery url %v", m.Name, m.PeerURLs, ma.discoveryURL)
-		} else {
-			glog.Infof("Dead member %s=%q removed from discovery url %v", m.Name, m.PeerURLs, ma.discoveryURL)
+		o := ma.cc.observe(ctx, client.Member{
+			Name:       m.Name,
+			ID:         m.ID,
+			PeerURLs:   []string{u},
+			ClientURLs: cus,
+		})
+		if o.Error != "" {
+			glog.Warningf("Error checking member %s health: %s", m.Name, o.Error)
+		} else if o.Active {
+			glog.V(5).Infof("Member %s=%s found to be alive and active", m.Name, u)
 		}
+		observations = append(observations, o)
+	}
+	return observations
+}
+
+func (ma *memberAdder) removeMember(ctx context.Context, m client.Member) error {
+	rec := &journalRecord{
+		Action:   RemoveMemberAction,
+		State:    journalIntended,
+		ID:       m.ID,
+		Name:     m.Name,
+		PeerURLs: m.PeerURLs,
+	}
+	if err := ma.journal.write(rec); err != nil {
+		return fmt.Errorf("cannot write journal %s: %v", ma.journal.path, err)
+	}
+
+	glog.V(4).Infof("Trying to remove dead member %s=%v", m.Name, m.PeerURLs)
+	err := ma.mapi.Remove(ctx, m.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't remove dead member %s=%v: %v", m.Name, m.PeerURLs, err)
+	}
+	glog.Infof("Removed dead member %s=%q", m.Name, m.PeerURLs)
+	rec.State = journalApplied
+	ma.record(rec)
 
-		deleted = append(deleted, &m)
-		break
+	// the member is gone from the cluster. There is no way back, hence retry the
+	// idempotent delete to leave the discovery service consistent.
+	glog.V(4).Infof("Trying to remove dead member %s=%v from discovery %v", m.Name, m.PeerURLs, ma.backend)
+	var found bool
+	err = retry(ctx, "remove dead member from discovery", ma.attempts, ma.retryInterval, func() error {
+		var err error
+		found, err = ma.backend.Delete(ctx, m.ID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("removed dead member %s=%v from the cluster, but couldn't remove it from discovery %v: %v", m.Name, m.PeerURLs, ma.backend, err)
+	}
+	if !found {
+		glog.V(2).Infof("Dead member %s=%q not found in discovery %v", m.Name, m.PeerURLs, ma.backend)
+	} else {
+		glog.Infof("Dead member %s=%q removed from discovery %v", m.Name, m.PeerURLs, ma.backend)
 	}
+	ma.forgetRecord()
 
-	return deleted, nil
+	if err := ma.dead.forget(ctx, m); err != nil {
+		glog.Warningf("Cannot clear dead-since record of removed member %s: %v", m.ID, err)
+	}
+	return nil
+}
+
+// joinQuorum checks whether the healthy members satisfy the quorum of a cluster with the
+// given started and unstarted members after adding a new member which does not start up.
+// Moreover, the cluster must tolerate minFaultTolerance member losses once the new member
+// has started. It returns the arithmetic for logging.
+func joinQuorum(started, unstarted, healthy, minFaultTolerance int) (string, error) {
+	if started == 1 && unstarted == 0 && minFaultTolerance == 0 {
+		glog.Infof("One node cluster found. Joining is always unsafe, nothing to do about that. Continuing.")
+		return "one node cluster, joining is always unsafe", nil
+	}
+
+	future := started + unstarted + 1
+	futureQuorum := future/2 + 1
+	if healthy < futureQuorum {
+		err := &QuorumError{Arithmetic: fmt.Sprintf("cannot add another member temporarily to the %d member "+
+			"cluster (with %d members up and %d unstarted) because we put the future quorum %d at risk",
+			started, healthy, unstarted, futureQuorum)}
+		return err.Error(), err
+	}
+
+	tolerance := healthy + 1 - futureQuorum
+	arithmetic := fmt.Sprintf("future quorum %d of %d members is safe with %d healthy members, "+
+		"tolerating %d failures once started", futureQuorum, future, healthy, tolerance)
+	if tolerance < minFaultTolerance {
+		err := &QuorumError{Arithmetic: fmt.Sprintf("%s, but %d are required", arithmetic, minFaultTolerance)}
+		return err.Error(), err
+	}
+	return arithmetic, nil
 }
 
-func (ma *memberAdder) protectCluster(ctx context.Context) error {
+// protectCluster checks that the cluster is not full and that adding a member does not
+// put the quorum at risk. Unstarted members other than self occupy slots and count
+// against the quorum.
+func (ma *memberAdder) protectCluster(ctx context.Context, self *client.Member) error {
 	// check that we don't destroy the quorum
 	ms, err := ma.mapi.List(ctx)
 	if err != nil {
 		return err
 	}
+	step := Step{Action: ProtectClusterAction}
+	defer func() { ma.report.record(step) }()
+
 	startedMembers := 0
+	unstartedMembers := 0
 	healthyMembers := 0
 	for _, m := range ms {
 		if m.Name != "" {
 			startedMembers++
+		} else if self == nil || m.ID != self.ID {
+			unstartedMembers++
 		}
-		if alive(ctx, m) {
-			if isActive, err := active(ctx, m); isActive && err == nil {
-				healthyMembers++
-			}
+		os := ma.observeMember(ctx, m)
+		step.Observations = append(step.Observations, os...)
+		if active(os) {
+			healthyMembers++
 		}
 	}
 
-	if startedMembers >= ma.targetSize {
-		return fmt.Errorf("cluster is already full with %d members", ma.targetSize)
+	// unstarted members of concurrent joiners occupy their slots already
+	if startedMembers+unstartedMembers >= ma.targetSize {
+		glog.Infof("Cluster is already full with %d members", ma.targetSize)
+		step.Result = fmt.Sprintf("cluster is already full with %d members", ma.targetSize)
+		return ErrClusterFull
 	}
 
-	if startedMembers == 1 {
-		glog.Infof("One node cluster found. Joining is always unsafe, nothing to do about that. Continuing.")
-		return nil
+	step.Result, err = joinQuorum(startedMembers, unstartedMembers, healthyMembers, ma.minFaultTolerance)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Even when this new member does not successfully start up and join the cluster, "+
+		"the future quorum is not at risk: %s. Continuing.", step.Result)
+	return nil
+}
+
+// active returns true if any peer url of a member was observed alive and active.
+func active(os []Observation) bool {
+	for _, o := range os {
+		if o.Active {
+			return true
+		}
 	}
+	return false
+}
 
-	futureQuorum := (startedMembers+1)/2 + 1
-	if healthyMembers < futureQuorum {
-		return fmt.Errorf("cannot add another member temporarily to the %d member "+
-			"cluster (with %d members up) because we put the future quorum %d at risk",
-			startedMembers, healthyMembers, futureQuorum)
+// removalQuorum checks whether the healthy members of a cluster with the given number of
+// members satisfy the quorum after removing one member, and, if regrow is true, after
+// adding a new member which does not start up. The regrown cluster must tolerate
+// minFaultTolerance member losses once the new member has started. It returns the
+// arithmetic for logging.
+func removalQuorum(members, healthy int, removeActive, regrow bool, minFaultTolerance int) (string, error) {
+	remaining := healthy
+	if removeActive {
+		remaining--
 	}
-	glog.Infof("Even when this new member does not successfully start up and join the cluster, "+
-		"the future quorum %d is not at risk. Continuing.", futureQuorum)
+
+	shrunkQuorum := (members-1)/2 + 1
+	arithmetic := fmt.Sprintf("removing a member of %d leaves %d healthy of %d members with quorum %d",
+		members, remaining, members-1, shrunkQuorum)
+	if remaining < shrunkQuorum {
+		return arithmetic, &QuorumError{Arithmetic: arithmetic + ": quorum at risk"}
+	}
+	if !regrow {
+		return arithmetic, nil
+	}
+	if members-1 == 1 && minFaultTolerance == 0 {
+		// compare joinQuorum, growing a one member cluster is always unsafe
+		return arithmetic + ", adding to a one member cluster is always unsafe", nil
+	}
+
+	regrownQuorum := members/2 + 1
+	tolerance := remaining + 1 - regrownQuorum
+	arithmetic = fmt.Sprintf("%s, adding a new member needs quorum %d of %d members and tolerates %d failures once started",
+		arithmetic, regrownQuorum, members, tolerance)
+	if remaining < regrownQuorum || tolerance < minFaultTolerance {
+		return arithmetic, &QuorumError{Arithmetic: arithmetic + ": quorum at risk"}
+	}
+	return arithmetic, nil
+}
+
+// protectRemoval checks that removing the member does not put the quorum at risk, neither
+// of the shrunken nor, if a new member is to be added, of the regrown cluster.
+func (ma *memberAdder) protectRemoval(m client.Member, members, healthy int, wasActive, regrow bool) error {
+	arithmetic, err := removalQuorum(members, healthy, wasActive, regrow, ma.minFaultTolerance)
+	step := Step{
+		Action:   ProtectClusterAction,
+		Name:     m.Name,
+		ID:       m.ID,
+		PeerURLs: m.PeerURLs,
+		Result:   arithmetic,
+	}
+	if err != nil {
+		step.Result = err.Error()
+		ma.report.record(step)
+		glog.Warningf("Not removing member %s=%v: %v", m.Name, m.PeerURLs, err)
+		return err
+	}
+	ma.report.record(step)
+	glog.Infof("Removing member %s=%v is safe: %s", m.Name, m.PeerURLs, arithmetic)
 	return nil
 }
 
+// Add asks the strategy's Decider what to do, removes the members it selects and adds
+// this instance to the cluster and the discovery service if decided so. It returns the
+// peer urls for the initial cluster.
 func (ma *memberAdder) Add(
 	ctx context.Context,
 	name string,
 	urls []string,
+	clientURLs []string,
 ) ([]string, error) {
+	d, err := decider(ma.strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := ma.lock.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	glog.V(4).Info("Getting cluster members")
 	ms, err := ma.mapi.List(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	unstarted := ma.findUnstartedMember(ms, urls)
-	if unstarted != nil {
-		glog.Infof("Found matching member entry %s=%v, no need to add", unstarted.Name, unstarted.PeerURLs)
+	self, err := ma.reconcile(ctx, ms, urls)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := ma.protectCluster(ctx); err != nil {
+	c := &Cluster{
+		Members:    ms,
+		Self:       self,
+		Name:       name,
+		PeerURLs:   urls,
+		Fresh:      ma.fresh,
+		TargetSize: ma.targetSize,
+		observe: func(m client.Member) ([]Observation, bool) {
+			os, dead, result := ma.dead.check(ctx, m, func() []Observation {
+				return ma.observeMember(ctx, m)
+			})
+			ma.report.record(Step{
+				Action:       ProbeMemberAction,
+				Name:         m.Name,
+				ID:           m.ID,
+				PeerURLs:     m.PeerURLs,
+				Result:       result,
+				Observations: os,
+			})
+			return os, dead
+		},
+	}
+
+	decision, err := d.Decide(c)
+	if err != nil {
+		return nil, err
+	}
+	if decision.Add && !ma.fresh {
+		return nil, fmt.Errorf("strategy %q decided to add this instance, but its data dir is not fresh", string(ma.strategy))
+	}
+
+	remove := decision.Remove
+	if ma.maxRemovals > 0 && len(remove) > ma.maxRemovals {
+		glog.Warningf("Strategy %q decided to remove %d members, removing only %d in this run",
+			string(ma.strategy), len(remove), ma.maxRemovals)
+		remove = remove[:ma.maxRemovals]
+	}
+	members := len(ms)
+	healthy := 0
+	if len(remove) > 0 {
+		for _, m := range ms {
+			if active(c.Observations(m)) {
+				healthy++
+			}
+		}
+	}
+	for _, m := range remove {
+		wasActive := active(c.Observations(m))
+		if err := ma.protectRemoval(m, members, healthy, wasActive, decision.Add); err != nil {
+			return nil, err
+		}
+		if err := ma.removeMember(ctx, m); err != nil {
 			return nil, err
 		}
+		members--
+		if wasActive {
+			healthy--
+		}
+	}
 
-		return unstarted.PeerURLs, nil
+	if decision.Update != nil {
+		return ma.updateMember(ctx, *decision.Update, name, urls, clientURLs)
 	}
 
-	switch ma.strategy {
-	case ReplaceStrategy:
-		if len(ms) >= ma.targetSize {
-			var removed []*client.Member
-			removed, err = ma.removeDeadMembersN(ctx, ms, 1)
-			if err != nil {
-				return nil, err
-			}
-			if len(removed) == 0 {
-				return nil, errors.New("full cluster and no dead member")
-			}
-		} else {
-			glog.Infof("Cluster not full with %d member our of %d. Going ahead with adding.", len(ms), ma.targetSize)
+	if !decision.Add {
+		glog.Infof("Strategy %q decided not to add this instance as a member.", string(ma.strategy))
+		return urls[:1], nil
+	}
+
+	if c.Self != nil {
+		glog.Infof("Found matching member entry %s=%v, no need to add", c.Self.Name, c.Self.PeerURLs)
+		ma.report.record(Step{
+			Action:   AddMemberAction,
+			ID:       c.Self.ID,
+			PeerURLs: c.Self.PeerURLs,
+			Result:   "matching unstarted member entry found, no need to add",
+		})
+
+		if err := ma.protectCluster(ctx, c.Self); err != nil {
+			return nil, err
 		}
-	case PruneStrategy:
-		_, err = ma.removeDeadMembersN(ctx, ms, len(ms))
-		if err != nil {
+
+		// a previous run might have failed after adding the member, before publishing it
+		if err := ma.publish(ctx, c.Self.ID, name, urls, clientURLs); err != nil {
 			return nil, err
 		}
+		ma.record(&journalRecord{
+			Action:     AddMemberAction,
+			State:      journalDone,
+			ID:         c.Self.ID,
+			Name:       name,
+			PeerURLs:   c.Self.PeerURLs,
+			ClientURLs: clientURLs,
+		})
+
+		return c.Self.PeerURLs, nil
+	}
+
+	if len(decision.Remove) == 0 && len(ms) < ma.targetSize {
+		glog.Infof("Cluster not full with %d member our of %d. Going ahead with adding.", len(ms), ma.targetSize)
 	}
 
-	if err := ma.protectCluster(ctx); err != nil {
+	if err := ma.protectCluster(ctx, c.Self); err != nil {
 		return nil, err
 	}
 
 	// add first of our peer urls. We cannot add all because we have to decide later which
 	// one is stated in the initial-cluster parameter. That one will be used to compute the
 	// member id.
+	rec := &journalRecord{
+		Action:     AddMemberAction,
+		State:      journalIntended,
+		Name:       name,
+		PeerURLs:   urls,
+		ClientURLs: clientURLs,
+	}
+	if err := ma.journal.write(rec); err != nil {
+		return nil, fmt.Errorf("cannot write journal %s: %v", ma.journal.path, err)
+	}
+
 	glog.V(4).Infof("Trying to add member with peer url %s", urls[0])
 	m, err := ma.mapi.Add(ctx, urls[0])
 	if err != nil {
+		ma.forgetRecord()
 		return nil, err
 	}
 	glog.Infof("Added member with peer url %s", urls[0])
+	rec.State = journalApplied
+	rec.ID = m.ID
+	ma.record(rec)
 
-	added, err := discovery.Add(ctx, ma.discoveryURL, &discovery.Machine{
-		Member: client.Member{
-			Name:     name,
-			ID:       m.ID,
-			PeerURLs: urls,
-		},
+	if err := ma.publish(ctx, m.ID, name, urls, clientURLs); err != nil {
+		// compensate, otherwise the unstarted member counts against the quorum forever
+		glog.Warningf("Removing member %s again: %v", m.ID, err)
+		rerr := retry(ctx, "remove unpublished member", ma.attempts, ma.retryInterval, func() error {
+			return ma.mapi.Remove(ctx, m.ID)
+		})
+		if rerr != nil {
+			return nil, fmt.Errorf("%v, and couldn't remove member %s again: %v", err, m.ID, rerr)
+		}
+		glog.Infof("Removed unpublished member %s", m.ID)
+		ma.forgetRecord()
+		return nil, err
+	}
+	rec.State = journalDone
+	ma.record(rec)
+
+	return []string{urls[0]}, nil
+}
+
+// updateMember replaces the peer urls of a member and rewrites its discovery entry.
+func (ma *memberAdder) updateMember(
+	ctx context.Context,
+	m client.Member,
+	name string,
+	urls []string,
+	clientURLs []string,
+) ([]string, error) {
+	rec := &journalRecord{
+		Action:     UpdateMemberAction,
+		State:      journalIntended,
+		ID:         m.ID,
+		Name:       name,
+		PeerURLs:   urls,
+		ClientURLs: clientURLs,
+	}
+	if err := ma.journal.write(rec); err != nil {
+		return nil, fmt.Errorf("cannot write journal %s: %v", ma.journal.path, err)
+	}
+
+	glog.V(4).Infof("Trying to update peer urls of member %s=%v to %v", m.Name, m.PeerURLs, urls)
+	if err := ma.mapi.Update(ctx, m.ID, urls); err != nil {
+		ma.forgetRecord()
+		return nil, fmt.Errorf("couldn't update member %s=%v: %v", m.Name, m.PeerURLs, err)
+	}
+	glog.Infof("Updated peer urls of member %s from %v to %v", m.Name, m.PeerURLs, urls)
+	rec.State = journalApplied
+	ma.record(rec)
+
+	if err := ma.rewrite(ctx, m.ID, name, urls, clientURLs); err != nil {
+		// compensate by restoring the old peer urls and discovery entry
+		glog.Warningf("Restoring peer urls %v of member %s: %v", m.PeerURLs, m.Name, err)
+		rerr := retry(ctx, "restore member peer urls", ma.attempts, ma.retryInterval, func() error {
+			return ma.mapi.Update(ctx, m.ID, m.PeerURLs)
+		})
+		if rerr != nil {
+			return nil, fmt.Errorf("couldn't rewrite discovery entry of member %s: %v, and couldn't restore its peer urls: %v", m.Name, err, rerr)
+		}
+		ma.forgetRecord()
+		if _, aerr := ma.backend.Add(ctx, &discovery.Machine{Member: m}); aerr != nil {
+			glog.Warningf("Couldn't restore discovery entry of member %s: %v", m.Name, aerr)
+		}
+		return nil, fmt.Errorf("couldn't rewrite discovery entry of member %s, restored its peer urls: %v", m.Name, err)
+	}
+	glog.Infof("Rewrote %s=%v in discovery %v", m.ID, urls, ma.backend)
+	ma.forgetRecord()
+
+	return urls, nil
+}
+
+// rewrite replaces the discovery entry of a member. It is idempotent and retried
+// because the cluster membership has already been changed.
+func (ma *memberAdder) rewrite(ctx context.Context, id, name string, urls, clientURLs []string) error {
+	return retry(ctx, "rewrite discovery entry", ma.attempts, ma.retryInterval, func() error {
+		if _, err := ma.backend.Delete(ctx, id); err != nil {
+			return err
+		}
+		_, err := ma.backend.Add(ctx, &discovery.Machine{
+			Member: client.Member{
+				Name:       name,
+				ID:         id,
+				PeerURLs:   urls,
+				ClientURLs: clientURLs,
+			},
+		})
+		return err
+	})
+}
+
+// publish adds this instance to the discovery service. It is idempotent and retried
+// because the cluster membership has already been changed.
+func (ma *memberAdder) publish(ctx context.Context, id, name string, urls, clientURLs []string) error {
+	var added bool
+	err := retry(ctx, "add member to discovery", ma.attempts, ma.retryInterval, func() error {
+		var err error
+		added, err = ma.backend.Add(ctx, &discovery.Machine{
+			Member: client.Member{
+				Name:       name,
+				ID:         id,
+				PeerURLs:   urls,
+				ClientURLs: clientURLs,
+			},
+		})
+		return err
 	})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("couldn't add member %s=%v to discovery %v: %v", id, urls, ma.backend, err)
 	}
 	if added {
-		glog.Infof("Added %s=%v to discovery url %s", m.ID, urls, ma.discoveryURL)
+		glog.Infof("Added %s=%v to discovery %v", id, urls, ma.backend)
 	}
-
-	return []string{urls[0]}, nil
+	return nil
 }
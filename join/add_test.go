@@ -0,0 +1,293 @@
+package join
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/rafthttp"
+	"github.com/sttts/elastic-etcd/discovery"
+	"golang.org/x/net/context"
+)
+
+// newFakeEtcd starts a server which answers peer liveness probes and leader requests like
+// a healthy etcd member, on the same port for peers and clients.
+func newFakeEtcd(leader string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(rafthttp.ProbingPrefix, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/v2/members/leader", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":%q,"name":%q}`, leader, leader)
+	})
+	return httptest.NewServer(mux)
+}
+
+type fakeMembersAPI struct {
+	client.MembersAPI
+	members []client.Member
+}
+
+func (f *fakeMembersAPI) List(ctx context.Context) ([]client.Member, error) {
+	return append([]client.Member{}, f.members...), nil
+}
+
+func (f *fakeMembersAPI) Add(ctx context.Context, peerURL string) (*client.Member, error) {
+	m := client.Member{ID: fmt.Sprintf("new-%d", len(f.members)), PeerURLs: []string{peerURL}}
+	f.members = append(f.members, m)
+	return &m, nil
+}
+
+func (f *fakeMembersAPI) Remove(ctx context.Context, id string) error {
+	for i, m := range f.members {
+		if m.ID == id {
+			f.members = append(f.members[:i], f.members[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+// flakyBackend fails the first failures Add and Delete calls.
+type flakyBackend struct {
+	discovery.Backend
+	failures int
+	entries  map[string]bool
+}
+
+func (f *flakyBackend) Add(ctx context.Context, m *discovery.Machine) (bool, error) {
+	if f.failures > 0 {
+		f.failures--
+		return false, errors.New("discovery unavailable")
+	}
+	added := !f.entries[m.ID]
+	f.entries[m.ID] = true
+	return added, nil
+}
+
+func (f *flakyBackend) Delete(ctx context.Context, id string) (bool, error) {
+	if f.failures > 0 {
+		f.failures--
+		return false, errors.New("discovery unavailable")
+	}
+	found := f.entries[id]
+	delete(f.entries, id)
+	return found, nil
+}
+
+func (f *flakyBackend) String() string {
+	return "flaky"
+}
+
+func TestAddCompensation(t *testing.T) {
+	ctx := context.Background()
+	urls := []string{"http://10.0.0.2:2380"}
+
+	tests := []struct {
+		failures  int
+		expectErr bool
+		members   int
+		entries   int
+	}{
+		{0, false, 2, 1},
+		{2, false, 2, 1},
+		{10, true, 1, 0},
+	}
+	for i, test := range tests {
+		mapi := &fakeMembersAPI{members: []client.Member{{ID: "1", Name: "a"}}}
+		backend := &flakyBackend{failures: test.failures, entries: map[string]bool{}}
+		opts := Options{Name: "b", Strategy: AddStrategy, ClientPort: 2379, Fresh: true}
+		ma, err := newMemberAdder(opts, 3, mapi, nil, backend, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ma.retryInterval = 0
+
+		_, err = ma.Add(ctx, "b", urls, nil)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		if len(mapi.members) != test.members || len(backend.entries) != test.entries {
+			t.Errorf("%d: expected %d members and %d discovery entries, got %v and %v",
+				i, test.members, test.entries, mapi.members, backend.entries)
+		}
+	}
+}
+
+func TestRemovalQuorum(t *testing.T) {
+	tests := []struct {
+		members, healthy     int
+		removeActive, regrow bool
+		minFaultTolerance    int
+		expectErr            bool
+	}{
+		{3, 2, false, true, 0, false},
+		{5, 3, false, true, 0, false},
+		{5, 2, false, true, 0, true},
+		{3, 1, false, false, 0, true},
+		{4, 2, false, true, 0, true},
+		{4, 2, false, false, 0, false},
+		{3, 3, true, true, 0, false},
+		{2, 1, false, true, 0, false},
+		{1, 0, false, true, 0, true},
+		{3, 2, false, true, 1, false},
+		{5, 3, false, true, 1, false},
+		{5, 3, false, true, 2, true},
+		{2, 1, false, true, 1, true},
+	}
+	for i, test := range tests {
+		arithmetic, err := removalQuorum(test.members, test.healthy, test.removeActive, test.regrow, test.minFaultTolerance)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%d: unexpected error %v: %s", i, err, arithmetic)
+		}
+		if _, ok := err.(*QuorumError); err != nil && !ok {
+			t.Errorf("%d: expected quorum error, got %v", i, err)
+		}
+	}
+}
+
+func TestJoinQuorum(t *testing.T) {
+	tests := []struct {
+		started, unstarted, healthy int
+		minFaultTolerance           int
+		expectErr                   bool
+	}{
+		{1, 0, 1, 0, false},
+		{1, 0, 1, 1, true},
+		{2, 0, 2, 0, false},
+		{2, 0, 2, 1, false},
+		{3, 0, 2, 0, true},
+		{3, 0, 3, 0, false},
+		{3, 0, 3, 1, false},
+		{3, 0, 3, 2, true},
+		{3, 1, 3, 0, false},
+		{3, 1, 3, 1, false},
+		{2, 1, 2, 0, true},
+		{4, 0, 4, 2, false},
+		{4, 1, 4, 2, true},
+	}
+	for i, test := range tests {
+		arithmetic, err := joinQuorum(test.started, test.unstarted, test.healthy, test.minFaultTolerance)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%d: unexpected error %v: %s", i, err, arithmetic)
+		}
+		if err != nil && !IsUnsafe(err) {
+			t.Errorf("%d: expected an unsafe error, got %v", i, err)
+		}
+	}
+}
+
+func TestObserveMemberClientURLs(t *testing.T) {
+	ctx := context.Background()
+	a := newFakeEtcd("1")
+	defer a.Close()
+	b := newFakeEtcd("1")
+	defer b.Close()
+	c := newFakeEtcd("1")
+	defer c.Close()
+
+	// neither member listens on the global client port
+	ma, err := newMemberAdder(Options{ClientPort: 1}, 3, nil, nil, nil, []discovery.Machine{
+		{Member: client.Member{PeerURLs: []string{c.URL}, ClientURLs: []string{c.URL}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []client.Member{
+		{ID: "1", Name: "a", PeerURLs: []string{a.URL}, ClientURLs: []string{a.URL}},
+		{ID: "2", Name: "b", PeerURLs: []string{b.URL}, ClientURLs: []string{b.URL}},
+		{ID: "3", PeerURLs: []string{c.URL}},
+	} {
+		os := ma.observeMember(ctx, m)
+		if len(os) != 1 || !os[0].Active {
+			t.Errorf("expected member %s to be active, got %+v", m.ID, os)
+		}
+	}
+
+	os := ma.observeMember(ctx, client.Member{ID: "4", PeerURLs: []string{a.URL}})
+	if len(os) != 1 || os[0].Active {
+		t.Errorf("expected a legacy member on the wrong client port not to be active, got %+v", os)
+	}
+}
+
+func TestConcurrentJoiners(t *testing.T) {
+	ctx := context.Background()
+	mapi := &fakeMembersAPI{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		srv := newFakeEtcd("1")
+		defer srv.Close()
+		mapi.members = append(mapi.members, client.Member{
+			ID:         name,
+			Name:       name,
+			PeerURLs:   []string{srv.URL},
+			ClientURLs: []string{srv.URL},
+		})
+	}
+	backend := &flakyBackend{entries: map[string]bool{}}
+	kapi := &fakeKeysAPI{values: map[string]string{}}
+
+	// the first joiner adds its member, which does not listen yet
+	first, err := newMemberAdder(Options{Name: "e", Strategy: AddStrategy, Fresh: true}, 5, mapi, kapi, backend, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Add(ctx, "e", []string{"http://127.0.0.1:1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(mapi.members) != 5 {
+		t.Fatalf("expected 5 members, got %v", mapi.members)
+	}
+
+	for _, test := range []struct {
+		strategy       Strategy
+		unstartedGrace time.Duration
+		err            error
+		remaining      string
+	}{
+		{AddStrategy, 0, ErrClusterFull, "http://127.0.0.1:1"},
+		{ReplaceStrategy, 10 * time.Minute, ErrNoDeadMember, "http://127.0.0.1:1"},
+		{PruneStrategy, 10 * time.Minute, ErrClusterFull, "http://127.0.0.1:1"},
+		// without an unstarted grace period, the unstarted member is dead right away
+		{ReplaceStrategy, 0, nil, "http://127.0.0.1:2"},
+	} {
+		opts := Options{Name: "f", Strategy: test.strategy, Fresh: true, UnstartedMemberGrace: test.unstartedGrace}
+		second, err := newMemberAdder(opts, 5, mapi, kapi, backend, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := second.Add(ctx, "f", []string{"http://127.0.0.1:2"}, nil); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.strategy, test.err, err)
+		}
+		if len(mapi.members) != 5 || mapi.members[4].PeerURLs[0] != test.remaining {
+			t.Errorf("%s: expected 5 members, the last with peer url %s, got %v", test.strategy, test.remaining, mapi.members)
+		}
+	}
+}
+
+func TestAddNotFresh(t *testing.T) {
+	ctx := context.Background()
+	RegisterStrategy("test-add-always", DeciderFunc(func(c *Cluster) (*Decision, error) {
+		return &Decision{Add: true}, nil
+	}))
+	defer unregisterStrategy("test-add-always")
+
+	mapi := &fakeMembersAPI{members: []client.Member{{ID: "1", Name: "a"}}}
+	backend := &flakyBackend{entries: map[string]bool{}}
+	opts := Options{Name: "b", Strategy: "test-add-always"}
+	ma, err := newMemberAdder(opts, 3, mapi, nil, backend, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ma.Add(ctx, "b", []string{"http://10.0.0.2:2380"}, nil); err == nil {
+		t.Errorf("expected error adding an instance with a non-fresh data dir")
+	}
+	if len(mapi.members) != 1 {
+		t.Errorf("expected no member to be added, got %v", mapi.members)
+	}
+}
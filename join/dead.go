@@ -0,0 +1,209 @@
+package join
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	// deadDir is the directory in the cluster keyspace where the time a member was
+	// first seen dead is stored, keyed by member id.
+	deadDir = "/elastic-etcd/dead"
+
+	deadProbeInterval = time.Second
+)
+
+// deadTracker decides whether a member has been dead long enough to be removed. It
+// requires a number of consecutive failed probes and, with a grace period, that the
+// member was continuously dead for that period. The first and the last time a member was
+// seen dead are persisted in the cluster keyspace such that they survive restarts. As
+// the member is only observed while elastic-etcd runs, it counts as continuously dead
+// only if no two observations are more than the grace period apart.
+type deadTracker struct {
+	kapi           client.KeysAPI
+	grace          time.Duration
+	unstartedGrace time.Duration
+	probes         int
+	dryRun         bool
+
+	interval      time.Duration
+	retryInterval time.Duration
+	now           func() time.Time
+}
+
+// newDeadTracker returns a deadTracker configured by the dead member options.
+func newDeadTracker(kapi client.KeysAPI, opts Options, dryRun bool) *deadTracker {
+	probes := opts.DeadMemberProbes
+	if probes < 1 {
+		probes = 1
+	}
+	return &deadTracker{
+		kapi:           kapi,
+		grace:          opts.DeadMemberGrace,
+		unstartedGrace: opts.UnstartedMemberGrace,
+		probes:         probes,
+		dryRun:         dryRun,
+		interval:       deadProbeInterval,
+		retryInterval:  mutationRetryInterval,
+		now:            time.Now,
+	}
+}
+
+// probesDead returns true if no observation shows an alive and active peer url, and
+// none could not be checked.
+func probesDead(os []Observation) bool {
+	if len(os) == 0 {
+		return false
+	}
+	for _, o := range os {
+		if o.Active || o.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// graceOf returns the grace period of a member. For unstarted members it is at least
+// the unstarted grace period.
+func (t *deadTracker) graceOf(m client.Member) time.Duration {
+	if m.Name == "" && t.grace < t.unstartedGrace {
+		return t.unstartedGrace
+	}
+	return t.grace
+}
+
+// check probes a member up to the configured number of times and returns the last
+// observations, whether the member may be considered dead and a human readable reason.
+func (t *deadTracker) check(
+	ctx context.Context,
+	m client.Member,
+	probe func() []Observation,
+) ([]Observation, bool, string) {
+	var os []Observation
+	for i := 0; i < t.probes; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return os, false, ctx.Err().Error()
+			case <-time.After(t.interval):
+			}
+		}
+		os = probe()
+		if !probesDead(os) {
+			if err := t.forget(ctx, m); err != nil {
+				glog.Warningf("Cannot clear dead-since record of member %s: %v", m.ID, err)
+			}
+			return os, false, "alive"
+		}
+	}
+
+	grace := t.graceOf(m)
+	if grace <= 0 {
+		return os, true, fmt.Sprintf("dead in %d consecutive probes", t.probes)
+	}
+
+	since, err := t.deadSince(ctx, m.ID, grace)
+	if err != nil {
+		glog.Warningf("Cannot get dead-since record of member %s, not considering it dead: %v", m.ID, err)
+		return os, false, fmt.Sprintf("dead, but dead-since record unavailable: %v", err)
+	}
+	dead := t.now().Sub(since)
+	if dead < grace {
+		glog.Infof("Member %s=%v is dead since %v, less than the grace period of %v", m.Name, m.PeerURLs, dead, grace)
+		return os, false, fmt.Sprintf("dead since %s, within grace period of %v", since.Format(time.RFC3339), grace)
+	}
+	return os, true, fmt.Sprintf("dead since %s, longer than grace period of %v", since.Format(time.RFC3339), grace)
+}
+
+// deadRecord is the value of a dead-since record.
+type deadRecord struct {
+	// Since is the time the member was first seen dead.
+	Since time.Time `json:"since"`
+
+	// LastSeen is the time the member was last seen dead.
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// parseDeadRecord parses a dead-since record.
+func parseDeadRecord(value string) (*deadRecord, error) {
+	rec := &deadRecord{}
+	if err := json.Unmarshal([]byte(value), rec); err != nil {
+		return nil, fmt.Errorf("invalid dead-since record %q: %v", value, err)
+	}
+	return rec, nil
+}
+
+// deadSince returns the time the member was first seen dead, recording now as the last
+// time it was seen dead. If it was not observed for longer than maxGap, or if it is the
+// first time, it is recorded as dead since now. Concurrent updates of the record are
+// retried a limited number of times.
+func (t *deadTracker) deadSince(ctx context.Context, id string, maxGap time.Duration) (time.Time, error) {
+	var since time.Time
+	err := retry(ctx, "record member "+id+" as dead", mutationAttempts, t.retryInterval, func() error {
+		var err error
+		since, err = t.recordDead(ctx, id, maxGap)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to record member %s as dead: %v", id, err)
+	}
+	return since, nil
+}
+
+// recordDead does one compare-and-swap attempt of deadSince.
+func (t *deadTracker) recordDead(ctx context.Context, id string, maxGap time.Duration) (time.Time, error) {
+	key := deadDir + "/" + id
+	now := t.now().UTC()
+	rec := &deadRecord{Since: now, LastSeen: now}
+
+	resp, err := t.kapi.Get(ctx, key, nil)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return time.Time{}, err
+	}
+	found := err == nil
+	if found {
+		old, err := parseDeadRecord(resp.Node.Value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if gap := now.Sub(old.LastSeen); gap > maxGap {
+			glog.Infof("Member %s was not observed for %v, restarting its grace period", id, gap)
+		} else {
+			rec.Since = old.Since
+		}
+	}
+	if t.dryRun {
+		return rec.Since, nil
+	}
+
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	opts := &client.SetOptions{PrevExist: client.PrevNoExist}
+	if found {
+		opts = &client.SetOptions{PrevValue: resp.Node.Value}
+	}
+	if _, err := t.kapi.Set(ctx, key, string(bs), opts); err != nil {
+		return time.Time{}, err
+	}
+	glog.V(2).Infof("Recorded member %s as dead since %s", id, rec.Since.Format(time.RFC3339))
+	return rec.Since, nil
+}
+
+// forget clears the dead-since record of a member.
+func (t *deadTracker) forget(ctx context.Context, m client.Member) error {
+	if t.graceOf(m) <= 0 || t.dryRun {
+		return nil
+	}
+	_, err := t.kapi.Delete(ctx, deadDir+"/"+m.ID, nil)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return err
+	}
+	return nil
+}
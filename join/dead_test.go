@@ -0,0 +1,176 @@
+package join
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// fakeKeysAPI is an in-memory KeysAPI supporting the calls of the deadTracker and
+// the joinLock. TTLs are ignored.
+type fakeKeysAPI struct {
+	client.KeysAPI
+	lock   sync.Mutex
+	values map[string]string
+}
+
+func (f *fakeKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	v, found := f.values[key]
+	if !found {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound}
+	}
+	return &client.Response{Node: &client.Node{Key: key, Value: v}}, nil
+}
+
+func (f *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	old, found := f.values[key]
+	if found && opts != nil && opts.PrevExist == client.PrevNoExist {
+		return nil, client.Error{Code: client.ErrorCodeNodeExist}
+	}
+	if opts != nil && opts.PrevValue != "" && (!found || old != opts.PrevValue) {
+		return nil, client.Error{Code: client.ErrorCodeTestFailed}
+	}
+	f.values[key] = value
+	return &client.Response{Node: &client.Node{Key: key, Value: value}}, nil
+}
+
+func (f *fakeKeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	old, found := f.values[key]
+	if !found {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound}
+	}
+	if opts != nil && opts.PrevValue != "" && old != opts.PrevValue {
+		return nil, client.Error{Code: client.ErrorCodeTestFailed}
+	}
+	delete(f.values, key)
+	return &client.Response{}, nil
+}
+
+// conflictingKeysAPI fails the given number of Set calls with a compare-and-swap
+// conflict, as if another instance was faster.
+type conflictingKeysAPI struct {
+	*fakeKeysAPI
+	conflicts int
+}
+
+func (f *conflictingKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	if f.conflicts > 0 {
+		f.conflicts--
+		return nil, client.Error{Code: client.ErrorCodeTestFailed}
+	}
+	return f.fakeKeysAPI.Set(ctx, key, value, opts)
+}
+
+func TestDeadSinceConflicts(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		conflicts int
+		err       bool
+	}{
+		{0, false},
+		{mutationAttempts - 1, false},
+		{mutationAttempts, true},
+	} {
+		kapi := &conflictingKeysAPI{fakeKeysAPI: &fakeKeysAPI{values: map[string]string{}}, conflicts: c.conflicts}
+		tr := newDeadTracker(kapi, Options{DeadMemberGrace: time.Minute}, false)
+		tr.retryInterval = 0
+		tr.now = func() time.Time { return now }
+
+		since, err := tr.deadSince(ctx, "1", time.Minute)
+		if c.err {
+			if err == nil {
+				t.Errorf("%d conflicts: expected an error", c.conflicts)
+			}
+			if len(kapi.values) != 0 {
+				t.Errorf("%d conflicts: expected no dead-since record, got %v", c.conflicts, kapi.values)
+			}
+			continue
+		}
+		if err != nil || !since.Equal(now) {
+			t.Errorf("%d conflicts: expected dead since %v, got %v, %v", c.conflicts, now, since, err)
+		}
+	}
+}
+
+func TestDeadTracker(t *testing.T) {
+	ctx := context.Background()
+	kapi := &fakeKeysAPI{values: map[string]string{}}
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := client.Member{ID: "1", Name: "a"}
+
+	probes := 0
+	dead := func() []Observation {
+		probes++
+		return []Observation{{}}
+	}
+	alive := func() []Observation {
+		probes++
+		return []Observation{{Alive: true, Active: true}}
+	}
+
+	tr := newDeadTracker(kapi, Options{DeadMemberProbes: 3}, false)
+	tr.interval = 0
+	if _, d, _ := tr.check(ctx, m, dead); !d || probes != 3 {
+		t.Errorf("expected dead after 3 probes, got dead=%v after %d probes", d, probes)
+	}
+	if len(kapi.values) != 0 {
+		t.Errorf("expected no dead-since record without grace period, got %v", kapi.values)
+	}
+
+	tr = newDeadTracker(kapi, Options{DeadMemberGrace: time.Minute}, false)
+	tr.now = func() time.Time { return now }
+	if _, d, _ := tr.check(ctx, m, dead); d {
+		t.Errorf("expected member within grace period not to be dead")
+	}
+	if rec, err := parseDeadRecord(kapi.values[deadDir+"/1"]); err != nil || !rec.Since.Equal(now) {
+		t.Errorf("expected dead-since record at %v, got %v, %v", now, rec, err)
+	}
+
+	// observations at most a grace period apart count as continuously dead. After a
+	// longer gap, e.g. the member might have flapped alive in between, the grace period
+	// starts again.
+	for _, o := range []struct {
+		after time.Duration
+		dead  bool
+	}{
+		{45 * time.Second, false},
+		{90 * time.Second, true},
+		{151 * time.Second, false},
+		{196 * time.Second, false},
+		{226 * time.Second, true},
+	} {
+		tr.now = func() time.Time { return now.Add(o.after) }
+		if _, d, _ := tr.check(ctx, m, dead); d != o.dead {
+			t.Errorf("after %v: expected dead=%v, got %v", o.after, o.dead, d)
+		}
+	}
+
+	if _, d, _ := tr.check(ctx, m, alive); d {
+		t.Errorf("expected alive member not to be dead")
+	}
+	if _, found := kapi.values[deadDir+"/1"]; found {
+		t.Errorf("expected dead-since record to be cleared for alive member")
+	}
+
+	tr = newDeadTracker(kapi, Options{DeadMemberGrace: time.Minute}, true)
+	if _, d, _ := tr.check(ctx, m, dead); d {
+		t.Errorf("expected member within grace period not to be dead in dry-run")
+	}
+	if len(kapi.values) != 0 {
+		t.Errorf("expected no dead-since record in dry-run, got %v", kapi.values)
+	}
+}
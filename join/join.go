@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,7 +16,7 @@ import (
 	"golang.org/x/net/context/ctxhttp"
 )
 
-// Strategy describes the member add strategy.
+// Strategy is the name of a registered join strategy, compare RegisterStrategy.
 type Strategy string
 
 const (
@@ -36,24 +35,75 @@ const (
 	// AddStrategy only adds a member until the cluster is full, never removes old members.
 	AddStrategy = Strategy("add")
 
+	// ReplaceByNameStrategy takes over a dead member with the same name, updating its
+	// peer urls. Without such a member it behaves like ReplaceStrategy.
+	ReplaceByNameStrategy = Strategy("replace-by-name")
+
 	maxUint = ^uint(0)
 	maxInt  = int(maxUint >> 1)
 )
 
+// Fallback describes what to do if an instance cannot join a full cluster.
+type Fallback string
+
+const (
+	// NoFallback fails the join.
+	NoFallback = Fallback("")
+
+	// ProxyFallback runs etcd as a proxy for the current members.
+	ProxyFallback = Fallback("proxy")
+)
+
 // EtcdConfig is the result of the join algorithm, turned into etcd flags or env vars.
 type EtcdConfig struct {
-	InitialCluster      []string
-	InitialClusterState string
-	AdvertisePeerURLs   string
-	Discovery           string
-	Name                string
+	InitialCluster      []string `json:"initialCluster,omitempty"`
+	InitialClusterState string   `json:"initialClusterState,omitempty"`
+	AdvertisePeerURLs   string   `json:"initialAdvertisePeerURLs,omitempty"`
+	Discovery           string   `json:"discovery,omitempty"`
+	DiscoverySRV        string   `json:"discoverySRV,omitempty"`
+	Proxy               string   `json:"proxy,omitempty"`
+	Name                string   `json:"name"`
 }
 
-func alive(ctx context.Context, m client.Member) bool {
+// ClientConfig describes how to talk to the members of an etcd cluster.
+type ClientConfig struct {
+	// Probe is used for the liveness probes of peer urls. If nil, http.DefaultClient
+	// is used.
+	Probe *http.Client
+
+	// Transport is used for the members API on client urls. If nil,
+	// client.DefaultTransport is used.
+	Transport client.CancelableTransport
+
+	// Username and Password authenticate against the members API if v2 auth is enabled.
+	Username string
+	Password string
+}
+
+// etcdConfig returns an etcd client config for the given client urls.
+func (cc ClientConfig) etcdConfig(endpoints []string, timeout time.Duration) client.Config {
+	tr := cc.Transport
+	if tr == nil {
+		tr = client.DefaultTransport
+	}
+	return client.Config{
+		Endpoints:               endpoints,
+		Transport:               tr,
+		Username:                cc.Username,
+		Password:                cc.Password,
+		HeaderTimeoutPerRequest: timeout,
+	}
+}
+
+func (cc ClientConfig) alive(ctx context.Context, m client.Member) bool {
 	ctx, _ = context.WithTimeout(ctx, livenessTimeout)
+	probe := cc.Probe
+	if probe == nil {
+		probe = http.DefaultClient
+	}
 	glog.V(6).Infof("Testing liveness of %s=%v", m.Name, m.PeerURLs)
 	for _, u := range m.PeerURLs {
-		resp, err := ctxhttp.Get(ctx, http.DefaultClient, u+rafthttp.ProbingPrefix)
+		resp, err := ctxhttp.Get(ctx, probe, u+rafthttp.ProbingPrefix)
 		if err == nil && resp.StatusCode == http.StatusOK {
 			return true
 		}
@@ -62,34 +112,52 @@ func alive(ctx context.Context, m client.Member) bool {
 	return false
 }
 
-func active(ctx context.Context, m client.Member) (bool, error) {
+func (cc ClientConfig) leader(ctx context.Context, m client.Member) (*client.Member, error) {
 	ctx, _ = context.WithTimeout(ctx, etcdTimeout)
 
-	c, err := client.New(client.Config{
-		Endpoints:               m.ClientURLs,
-		Transport:               client.DefaultTransport,
-		HeaderTimeoutPerRequest: 5 * time.Second,
-	})
+	c, err := client.New(cc.etcdConfig(m.ClientURLs, 5*time.Second))
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	mapi := client.NewMembersAPI(c)
 	glog.V(6).Infof("Testing whether %s=%v knows the leader", m.Name, m.PeerURLs)
-	leader, err := mapi.Leader(ctx)
+	return mapi.Leader(ctx)
+}
+
+// observe checks the liveness of a member and, if alive, whether it knows the leader.
+func (cc ClientConfig) observe(ctx context.Context, m client.Member) Observation {
+	o := Observation{
+		Name:     m.Name,
+		ID:       m.ID,
+		PeerURLs: m.PeerURLs,
+		Alive:    cc.alive(ctx, m),
+	}
+	if !o.Alive {
+		return o
+	}
+	leader, err := cc.leader(ctx, m)
 	if err != nil {
-		return false, err
+		o.Error = err.Error()
+		return o
+	}
+	if leader != nil {
+		o.Active = true
+		o.Leader = leader.ID
 	}
-	return leader != nil, nil
+	return o
 }
 
 func clusterExistingHeuristic(
 	ctx context.Context,
+	cc ClientConfig,
 	size int, nodes []discovery.Machine,
+	report *Report,
 ) ([]discovery.Machine, error) {
 	quorum := size/2 + 1
 
 	if nodes == nil {
 		glog.V(4).Infof("No nodes found in discovery service. Assuming new cluster.")
+		report.record(Step{Action: DiscoverAction, Result: "no discovery entries, new cluster"})
 		return nil, nil
 	}
 
@@ -97,16 +165,19 @@ func clusterExistingHeuristic(
 	wg.Add(len(nodes))
 	lock := sync.Mutex{}
 	activeNodes := make([]discovery.Machine, 0, len(nodes))
-	for _, n := range nodes {
-		go func(n discovery.Machine) {
+	observations := make([]Observation, len(nodes))
+	for i, n := range nodes {
+		go func(i int, n discovery.Machine) {
 			defer wg.Done()
-			if !alive(ctx, n.Member) {
+			o := cc.observe(ctx, n.Member)
+			observations[i] = o
+			if !o.Alive {
 				glog.Infof("Node %s looks dead", n.NamedPeerURLs())
 				return
 			}
-			if ok, err := active(ctx, n.Member); !ok {
-				if err != nil {
-					glog.Error(err)
+			if !o.Active {
+				if o.Error != "" {
+					glog.Error(o.Error)
 				}
 				glog.Infof("Node %s is not in a healthy cluster.", n.NamedPeerURLs())
 				return
@@ -115,80 +186,155 @@ func clusterExistingHeuristic(
 			lock.Lock()
 			defer lock.Unlock()
 			activeNodes = append(activeNodes, n)
-		}(n)
+		}(i, n)
 	}
 	wg.Wait()
 
+	step := Step{Action: DiscoverAction, Observations: observations}
+	defer func() { report.record(step) }()
+
 	if len(nodes) < quorum {
 		glog.V(4).Infof(
 			"Only %d nodes found in discovery service, less than a quorum of %d. Assuming new cluster.",
 			len(nodes),
 			quorum,
 		)
+		step.Result = fmt.Sprintf("%d discovery entries, less than a quorum of %d, new cluster", len(nodes), quorum)
 		return nil, nil
 	}
 
 	if len(nodes) == size {
 		glog.V(4).Infof("Cluster is full. Assuming existing cluster.")
+		step.Result = fmt.Sprintf("%d of %d discovery entries, %d active, existing cluster", len(nodes), size, len(activeNodes))
 		return activeNodes, nil
 	}
 
 	if len(activeNodes) > 0 {
+		step.Result = fmt.Sprintf("%d active of %d discovery entries, existing cluster", len(activeNodes), len(nodes))
 		return activeNodes, nil
 	}
 
+	step.Result = fmt.Sprintf("no active node among %d discovery entries, new cluster", len(nodes))
 	return nil, nil
 }
 
+// Options are the input of the join algorithm.
+type Options struct {
+	// Backend is the discovery backend to find the cluster members.
+	Backend discovery.Backend
+
+	// Name is the cluster-unique name of this instance.
+	Name string
+
+	// AdvertisePeerURLs are the peer urls of this instance. At least one is required.
+	AdvertisePeerURLs []string
+
+	// AdvertiseClientURLs are optional. If given, they are published in the discovery
+	// service.
+	AdvertiseClientURLs []string
+
+	// Fresh is true if the etcd data directory of this instance is empty.
+	Fresh bool
+
+	// ClientPort is the etcd client port of peers which do not publish their client urls.
+	ClientPort int
+
+	// ClusterSize is the maximal cluster size. If negative, it is taken from the
+	// discovery service. Zero means unlimited.
+	ClusterSize int
+
+	// Strategy is the member add strategy.
+	Strategy Strategy
+
+	// Client describes how to talk to the cluster members.
+	Client ClientConfig
+
+	// DeadMemberGrace is the duration a member must have been dead continuously before
+	// it may be removed. The time a member was first seen dead is stored in the cluster
+	// keyspace. Zero allows immediate removal.
+	DeadMemberGrace time.Duration
+
+	// UnstartedMemberGrace is the minimal grace period of unstarted members, e.g. of
+	// concurrent joiners whose etcd has not started yet. Zero means DeadMemberGrace.
+	UnstartedMemberGrace time.Duration
+
+	// DeadMemberProbes is the number of consecutive failed probes before a member is
+	// considered dead. Values below one mean a single probe.
+	DeadMemberProbes int
+
+	// MaxRemovals caps the number of members removed in one run. Zero means no limit.
+	MaxRemovals int
+
+	// MinFaultTolerance is the number of member losses the cluster must tolerate after
+	// this instance has joined. Otherwise the join is refused.
+	MinFaultTolerance int
+
+	// JoinLockTTL enables a lock in the cluster keyspace with this TTL, serializing the
+	// membership changes of concurrent joiners. Zero disables the lock.
+	JoinLockTTL time.Duration
+
+	// JournalPath is a local file recording the membership change in flight, such that
+	// a rerun after a crash resumes or reconciles it. It must not be inside the data
+	// dir. Empty disables the journal.
+	JournalPath string
+
+	// Fallback is used if the instance cannot join because the cluster is full.
+	Fallback Fallback
+
+	// WaitTimeout is the time to wait for a join which is not safe yet, compare IsUnsafe.
+	// Zero fails immediately.
+	WaitTimeout time.Duration
+}
+
 // Join adds a new member depending on the strategy and returns a matching etcd configuration.
-func Join(
-	discoveryURL, name, initialAdvertisePeerURLs string,
-	fresh bool,
-	clientPort, clusterSize int,
-	strategy Strategy,
-) (*EtcdConfig, error) {
-	ctx := context.Background()
-
-	res, err := discovery.Value(ctx, discoveryURL, "/")
-	if err != nil {
+// With a WaitTimeout, a join which is not safe yet is re-evaluated with exponential backoff
+// until it becomes safe or the timeout passes. Only then the fallback applies.
+func Join(ctx context.Context, opts Options) (*EtcdConfig, error) {
+	return newSafeJoiner().run(ctx, opts)
+}
+
+// join implements Join. With a non-nil report, it runs dry without mutating the cluster
+// or the discovery service and records its steps in the report.
+func join(ctx context.Context, opts Options, report *Report) (*EtcdConfig, error) {
+	if len(opts.AdvertisePeerURLs) == 0 {
+		return nil, errors.New("at least one advertised peer url is required")
+	}
+	if _, err := decider(opts.Strategy); err != nil {
 		return nil, err
 	}
-	nodes := make([]discovery.Machine, 0, len(res.Node.Nodes))
-	for _, nn := range res.Node.Nodes {
-		if nn.Value == nil {
-			glog.V(5).Infof("Skipping %q because no value exists", nn.Key)
-		}
-		var n *discovery.Machine
-		n, err = discovery.NewDiscoveryNode(*nn.Value, clientPort)
-		if err != nil {
-			glog.Warningf("invalid peer url %q in discovery service: %v", *nn.Value, err)
-			continue
-		}
-		nodes = append(nodes, *n)
+	initialAdvertisePeerURLs := strings.Join(opts.AdvertisePeerURLs, ",")
+	clusterSize := opts.ClusterSize
+
+	nodes, err := opts.Backend.Machines(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	if clusterSize < 0 {
-		res, err = discovery.Value(ctx, discoveryURL, "/_config/size")
+		clusterSize, err = opts.Backend.Size(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("cannot get discovery url cluster size: %v", err)
+			return nil, fmt.Errorf("cannot get discovery cluster size: %v", err)
 		}
 
-		size, _ := strconv.ParseInt(*res.Node.Value, 10, 16)
-		clusterSize = int(size)
-
-		glog.V(2).Infof("Got a target cluster size of %d from the discovery url", clusterSize)
+		glog.V(2).Infof("Got a target cluster size of %d from the discovery %v", clusterSize, opts.Backend)
 	} else if clusterSize == 0 {
 		clusterSize = maxInt
 	}
 
-	activeNodes, err := clusterExistingHeuristic(ctx, clusterSize, nodes)
+	activeNodes, err := clusterExistingHeuristic(ctx, opts.Client, clusterSize, nodes, report)
 	if err != nil {
 		return nil, err
 	}
 
 	if activeNodes != nil && len(activeNodes) == 0 {
 		// cluster down. Restarting nodes with the same config.
-		if fresh {
+		if opts.Fresh {
+			// SRV records are static. Hence, they cannot tell a dead cluster from one
+			// which is not bootstrapped yet.
+			if b, ok := opts.Backend.(discovery.SRVBootstrapper); ok && b.DiscoverySRV() != "" {
+				glog.Infof("No healthy node found for the SRV records. Assuming new cluster.")
+				return newCluster(opts.Backend, opts.Name, initialAdvertisePeerURLs)
+			}
 			return nil, errors.New("Cluster is down. A new node cannot join now.")
 		}
 
@@ -197,62 +343,113 @@ func Join(
 		return &EtcdConfig{
 			InitialClusterState: "existing",
 			AdvertisePeerURLs:   initialAdvertisePeerURLs,
-			Name:                name,
+			Name:                opts.Name,
 		}, nil
 	} else if activeNodes != nil {
-		activeNamedURLs := make([]string, 0, len(nodes))
-		for _, n := range activeNodes {
-			activeNamedURLs = append(activeNamedURLs, n.NamedPeerURLs()...)
-		}
-
-		advertisedURLs := strings.Split(initialAdvertisePeerURLs, ",")
+		advertisedURLs := opts.AdvertisePeerURLs
 
-		advertisedNamedURLs := make([]string, 0, len(initialAdvertisePeerURLs))
-		for _, u := range advertisedURLs {
-			advertisedNamedURLs = append(advertisedNamedURLs, fmt.Sprintf("%s=%s", name, u))
+		c, err := newClient(opts.Client, activeNodes)
+		if err != nil {
+			return nil, err
+		}
+		mapi := client.NewMembersAPI(c)
+		kapi := client.NewKeysAPI(c)
+		adderBackend := opts.Backend
+		if report != nil {
+			mapi = newDryRunMembersAPI(mapi, report)
+			adderBackend = &dryRunBackend{Backend: opts.Backend, report: report}
 		}
 
-		initialNamedURLs := []string{advertisedNamedURLs[0]}
-		if strategy != PreparedStrategy && fresh {
-			glog.Infof("Existing cluster found. Trying to join with %q strategy.", string(strategy))
-
-			adder, err := newMemberAdder(
-				activeNodes,
-				strategy,
-				clientPort,
-				clusterSize,
-				discoveryURL,
-			)
+		d, err := decider(opts.Strategy)
+		if err != nil {
+			return nil, err
+		}
+		selfURLs := advertisedURLs[:1]
+		if p, ok := d.(Passive); ok && p.Passive(opts.Fresh) {
+			glog.Infof("Existing cluster found. Trying to join without adding this instance as a member.")
+		} else {
+			if opts.Fresh {
+				glog.Infof("Existing cluster found. Trying to join with %q strategy.", string(opts.Strategy))
+			} else {
+				glog.Infof("Existing cluster found. Trying to rejoin with %q strategy.", string(opts.Strategy))
+			}
+			adder, err := newMemberAdder(opts, clusterSize, mapi, kapi, adderBackend, activeNodes, report)
 			if err != nil {
 				return nil, err
 			}
-			initialURLs, err := adder.Add(ctx, name, advertisedURLs)
+			selfURLs, err = adder.Add(ctx, opts.Name, advertisedURLs, opts.AdvertiseClientURLs)
+			if (err == ErrClusterFull || err == ErrNoDeadMember) && opts.Fallback == ProxyFallback {
+				glog.Infof("Cannot join: %v. Falling back to proxy mode.", err)
+				return proxy(ctx, mapi, opts.Name)
+			}
+			if IsUnsafe(err) {
+				return nil, err
+			}
 			if err != nil {
-				return nil, fmt.Errorf("unable to add node %q with peer urls %q to the cluster: %v", name, initialAdvertisePeerURLs, err)
+				return nil, fmt.Errorf("unable to add node %q with peer urls %q to the cluster: %v", opts.Name, initialAdvertisePeerURLs, err)
 			}
+		}
 
-			initialNamedURLs = []string{}
-			for _, u := range initialURLs {
-				initialNamedURLs = append(initialNamedURLs, fmt.Sprintf("%s=%s", name, u))
-			}
-		} else {
-			glog.Infof("Existing cluster found. Trying to join without adding this instance as a member.")
+		// discovery is only the seed, the member list is authoritative
+		members, err := mapi.List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list cluster members: %v", err)
+		}
+		if n := reportMembershipMismatch(nodes, members); n > 0 {
+			glog.Warningf("Discovery %v and cluster membership differ in %d entries. Using the cluster membership.", opts.Backend, n)
 		}
 
 		return &EtcdConfig{
-			InitialCluster:      append(initialNamedURLs, activeNamedURLs...),
+			InitialCluster:      initialCluster(members, opts.Name, advertisedURLs, selfURLs),
 			InitialClusterState: "existing",
 			AdvertisePeerURLs:   initialAdvertisePeerURLs,
-			Name:                name,
+			Name:                opts.Name,
 		}, nil
-	} else {
-		glog.Infof("Trying to launch new cluster.")
+	}
 
-		return &EtcdConfig{
-			InitialClusterState: "new",
-			Discovery:           discoveryURL,
-			AdvertisePeerURLs:   initialAdvertisePeerURLs,
-			Name:                name,
-		}, nil
+	return newCluster(opts.Backend, opts.Name, initialAdvertisePeerURLs)
+}
+
+// proxy returns an etcd configuration to run as a proxy for the started members.
+func proxy(ctx context.Context, mapi client.MembersAPI, name string) (*EtcdConfig, error) {
+	members, err := mapi.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list cluster members: %v", err)
+	}
+	initialCluster := []string{}
+	for _, m := range members {
+		if m.Name == "" {
+			continue
+		}
+		for _, u := range m.PeerURLs {
+			initialCluster = append(initialCluster, fmt.Sprintf("%s=%s", m.Name, u))
+		}
+	}
+	return &EtcdConfig{
+		InitialCluster: initialCluster,
+		Proxy:          "on",
+		Name:           name,
+	}, nil
+}
+
+// newCluster returns an etcd configuration to bootstrap a new cluster through the
+// discovery backend.
+func newCluster(backend discovery.Backend, name, initialAdvertisePeerURLs string) (*EtcdConfig, error) {
+	glog.Infof("Trying to launch new cluster.")
+
+	cfg := &EtcdConfig{
+		InitialClusterState: "new",
+		AdvertisePeerURLs:   initialAdvertisePeerURLs,
+		Name:                name,
+	}
+	if b, ok := backend.(discovery.Bootstrapper); ok {
+		cfg.Discovery = b.DiscoveryURL()
+	}
+	if b, ok := backend.(discovery.SRVBootstrapper); ok && cfg.Discovery == "" {
+		cfg.DiscoverySRV = b.DiscoverySRV()
+	}
+	if cfg.Discovery == "" && cfg.DiscoverySRV == "" {
+		return nil, fmt.Errorf("no existing cluster found and discovery %v cannot bootstrap a new one", backend)
 	}
+	return cfg, nil
 }
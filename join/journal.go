@@ -0,0 +1,192 @@
+package join
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	// journalIntended marks a membership change which is about to be applied to the
+	// cluster.
+	journalIntended = "intended"
+
+	// journalApplied marks a membership change applied to the cluster, but not yet to
+	// the discovery service.
+	journalApplied = "applied"
+
+	// journalDone marks a membership change applied to both the cluster and the
+	// discovery service.
+	journalDone = "done"
+)
+
+// journalRecord describes the last membership change of this instance.
+type journalRecord struct {
+	Action     Action    `json:"action"`
+	State      string    `json:"state"`
+	ID         string    `json:"id,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	PeerURLs   []string  `json:"peerURLs"`
+	ClientURLs []string  `json:"clientURLs,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// journal persists the membership change in flight in a local file, such that a rerun
+// after a crash can resume or reconcile it. An empty path disables the journal. In
+// dry-run mode it is only read.
+type journal struct {
+	path   string
+	dryRun bool
+}
+
+// read returns the last record, or nil if there is none.
+func (j *journal) read() (*journalRecord, error) {
+	if j.path == "" || !fileutil.Exist(j.path) {
+		return nil, nil
+	}
+	bs, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		return nil, err
+	}
+	r := &journalRecord{}
+	if err := json.Unmarshal(bs, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// write replaces the record, synced to disk before it is renamed into place.
+func (j *journal) write(r *journalRecord) error {
+	if j.path == "" || j.dryRun {
+		return nil
+	}
+	r.Time = time.Now().UTC()
+	bs, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+
+	// persist the rename itself
+	d, err := os.Open(filepath.Dir(j.path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// clear removes the record.
+func (j *journal) clear() error {
+	if j.path == "" || j.dryRun {
+		return nil
+	}
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// reconcile resumes or cleans up the membership change recorded in the journal by a
+// previous run. It returns the unstarted member of this instance, taken from the journal
+// if possible, otherwise guessed by the peer urls.
+func (ma *memberAdder) reconcile(ctx context.Context, ms []client.Member, urls []string) (*client.Member, error) {
+	rec, err := ma.journal.read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read journal %s: %v", ma.journal.path, err)
+	}
+	if rec == nil {
+		return ma.findUnstartedMember(ms, urls), nil
+	}
+	glog.Infof("Found journal record of %s action %s=%v in state %s", rec.Action, rec.ID, rec.PeerURLs, rec.State)
+
+	var member *client.Member
+	for i := range ms {
+		if rec.ID != "" && ms[i].ID == rec.ID {
+			member = &ms[i]
+			break
+		}
+	}
+
+	switch rec.Action {
+	case AddMemberAction:
+		if rec.ID == "" && len(rec.PeerURLs) > 0 {
+			// the add request might have succeeded before the response was journaled
+			for i := range ms {
+				if ms[i].Name == "" && samePeerURLs(ms[i].PeerURLs, rec.PeerURLs[:1]) {
+					member = &ms[i]
+					break
+				}
+			}
+		}
+		if member != nil && member.Name == "" {
+			glog.Infof("Resuming with unstarted member %s=%v from the journal", member.ID, member.PeerURLs)
+			return member, nil
+		}
+	case RemoveMemberAction:
+		if member == nil && rec.State != journalDone {
+			glog.Infof("Completing removal of member %s=%v from discovery %v", rec.ID, rec.PeerURLs, ma.backend)
+			err := retry(ctx, "remove member from discovery", ma.attempts, ma.retryInterval, func() error {
+				_, err := ma.backend.Delete(ctx, rec.ID)
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("cannot complete removal of member %s from discovery %v: %v", rec.ID, ma.backend, err)
+			}
+		}
+	case UpdateMemberAction:
+		if member != nil && samePeerURLs(member.PeerURLs, rec.PeerURLs) && rec.State != journalDone {
+			glog.Infof("Completing rewrite of discovery entry of member %s=%v", rec.ID, rec.PeerURLs)
+			if err := ma.rewrite(ctx, rec.ID, rec.Name, rec.PeerURLs, rec.ClientURLs); err != nil {
+				return nil, fmt.Errorf("cannot complete rewrite of discovery entry of member %s: %v", rec.ID, err)
+			}
+		}
+	}
+
+	if err := ma.journal.clear(); err != nil {
+		return nil, fmt.Errorf("cannot clear journal %s: %v", ma.journal.path, err)
+	}
+	return ma.findUnstartedMember(ms, urls), nil
+}
+
+// record journals the membership change in flight. Failures are only logged because
+// the change has been applied already.
+func (ma *memberAdder) record(r *journalRecord) {
+	if err := ma.journal.write(r); err != nil {
+		glog.Warningf("Cannot write journal %s: %v", ma.journal.path, err)
+	}
+}
+
+// forgetRecord clears the journal. Failures are only logged.
+func (ma *memberAdder) forgetRecord() {
+	if err := ma.journal.clear(); err != nil {
+		glog.Warningf("Cannot clear journal %s: %v", ma.journal.path, err)
+	}
+}
@@ -0,0 +1,93 @@
+package join
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func TestJournalReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elastic-etcd-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	urls := []string{"http://10.0.0.2:2380", "http://[fd00::2]:2380"}
+
+	tests := []struct {
+		name     string
+		record   *journalRecord
+		members  []client.Member
+		entries  map[string]bool
+		self     string
+		entriesN int
+		cleared  bool
+	}{
+		{
+			"applied add resumes with journaled id",
+			&journalRecord{Action: AddMemberAction, State: journalApplied, ID: "2", PeerURLs: urls},
+			[]client.Member{{ID: "1", Name: "a"}, {ID: "2", PeerURLs: urls[:1]}},
+			map[string]bool{}, "2", 0, false,
+		},
+		{
+			"intended add finds the member by its exact peer url",
+			&journalRecord{Action: AddMemberAction, State: journalIntended, PeerURLs: urls},
+			[]client.Member{{ID: "1", Name: "a"}, {ID: "3", PeerURLs: urls[:1]}},
+			map[string]bool{}, "3", 0, false,
+		},
+		{
+			"started member clears the journal",
+			&journalRecord{Action: AddMemberAction, State: journalDone, ID: "2", PeerURLs: urls},
+			[]client.Member{{ID: "1", Name: "a"}, {ID: "2", Name: "b", PeerURLs: urls[:1]}},
+			map[string]bool{}, "", 0, true,
+		},
+		{
+			"applied removal completes the discovery delete",
+			&journalRecord{Action: RemoveMemberAction, State: journalApplied, ID: "4"},
+			[]client.Member{{ID: "1", Name: "a"}},
+			map[string]bool{"1": true, "4": true}, "", 1, true,
+		},
+	}
+	for _, test := range tests {
+		j := &journal{path: filepath.Join(dir, "journal")}
+		if err := j.write(test.record); err != nil {
+			t.Fatal(err)
+		}
+		backend := &flakyBackend{entries: test.entries}
+		opts := Options{Name: "b", Strategy: AddStrategy, ClientPort: 2379, Fresh: true, JournalPath: j.path}
+		ma, err := newMemberAdder(opts, 3, &fakeMembersAPI{members: test.members}, nil, backend, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		self, err := ma.reconcile(ctx, test.members, urls)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		id := ""
+		if self != nil {
+			id = self.ID
+		}
+		if id != test.self {
+			t.Errorf("%s: expected self %q, got %q", test.name, test.self, id)
+		}
+		if len(backend.entries) != test.entriesN {
+			t.Errorf("%s: expected %d discovery entries, got %v", test.name, test.entriesN, backend.entries)
+		}
+		rec, err := j.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (rec == nil) != test.cleared {
+			t.Errorf("%s: expected journal cleared=%v, got %v", test.name, test.cleared, rec)
+		}
+		j.clear()
+	}
+}
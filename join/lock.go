@@ -0,0 +1,135 @@
+package join
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	// joinLockKey is the key in the cluster keyspace serializing membership changes of
+	// concurrent joiners.
+	joinLockKey = "/elastic-etcd/join-lock"
+
+	joinLockMinBackoff = time.Second
+	joinLockMaxBackoff = time.Second * 16
+)
+
+// joinLock is a TTL based lock in the cluster keyspace. The TTL is refreshed while the
+// lock is held. If the holder dies, the lock expires after the TTL.
+type joinLock struct {
+	kapi   client.KeysAPI
+	ttl    time.Duration
+	owner  string
+	dryRun bool
+	report *Report
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// newJoinLock returns a lock with an owner value unique to this instance. A zero TTL
+// disables the lock.
+func newJoinLock(kapi client.KeysAPI, ttl time.Duration, name string, dryRun bool, report *Report) (*joinLock, error) {
+	bs := make([]byte, 8)
+	if _, err := rand.Read(bs); err != nil {
+		return nil, fmt.Errorf("cannot generate join lock owner: %v", err)
+	}
+	return &joinLock{
+		kapi:       kapi,
+		ttl:        ttl,
+		owner:      fmt.Sprintf("%s/%s", name, hex.EncodeToString(bs)),
+		dryRun:     dryRun,
+		report:     report,
+		minBackoff: joinLockMinBackoff,
+		maxBackoff: joinLockMaxBackoff,
+	}, nil
+}
+
+// lock acquires the lock, waiting with exponential backoff while somebody else holds
+// it. The returned function releases the lock.
+func (l *joinLock) lock(ctx context.Context) (func(), error) {
+	if l.ttl <= 0 {
+		return func() {}, nil
+	}
+
+	if l.dryRun {
+		s := Step{Action: LockAction, Result: "would acquire the join lock, currently free"}
+		resp, err := l.kapi.Get(ctx, joinLockKey, nil)
+		if err == nil {
+			s.Result = fmt.Sprintf("would wait for the join lock, currently held by %s", resp.Node.Value)
+		} else if !client.IsKeyNotFound(err) {
+			return nil, fmt.Errorf("cannot get join lock: %v", err)
+		}
+		l.report.record(s)
+		return func() {}, nil
+	}
+
+	backoff := l.minBackoff
+	for {
+		_, err := l.kapi.Set(ctx, joinLockKey, l.owner, &client.SetOptions{
+			PrevExist: client.PrevNoExist,
+			TTL:       l.ttl,
+		})
+		if err == nil {
+			break
+		}
+		if cerr, ok := err.(client.Error); !ok || cerr.Code != client.ErrorCodeNodeExist {
+			return nil, fmt.Errorf("cannot acquire join lock: %v", err)
+		}
+
+		holder := "unknown"
+		if resp, err := l.kapi.Get(ctx, joinLockKey, nil); err == nil {
+			holder = resp.Node.Value
+		}
+		wait := jitter(backoff)
+		glog.Infof("Join lock held by %s. Waiting %v.", holder, wait)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for the join lock held by %s: %v", holder, ctx.Err())
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > l.maxBackoff {
+			backoff = l.maxBackoff
+		}
+	}
+	glog.V(2).Infof("Acquired join lock as %s", l.owner)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_, err := l.kapi.Set(ctx, joinLockKey, l.owner, &client.SetOptions{
+					PrevValue: l.owner,
+					TTL:       l.ttl,
+				})
+				if err != nil {
+					glog.Warningf("Cannot refresh join lock: %v", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		_, err := l.kapi.Delete(context.Background(), joinLockKey, &client.DeleteOptions{PrevValue: l.owner})
+		if err != nil {
+			glog.Warningf("Cannot release join lock, it will expire after %v: %v", l.ttl, err)
+			return
+		}
+		glog.V(2).Infof("Released join lock")
+	}, nil
+}
@@ -0,0 +1,78 @@
+package join
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestJoinLock(t *testing.T) {
+	ctx := context.Background()
+	kapi := &fakeKeysAPI{values: map[string]string{}}
+
+	first, err := newJoinLock(kapi, time.Minute, "a", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newJoinLock(kapi, time.Minute, "b", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.minBackoff = time.Millisecond
+	second.maxBackoff = 10 * time.Millisecond
+
+	unlock, err := first.lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := kapi.values[joinLockKey]; v != first.owner {
+		t.Fatalf("expected lock owner %q, got %q", first.owner, v)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		unlock, err := second.lock(ctx)
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock()
+		}
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected second contender to wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected second contender to acquire the lock after release")
+	}
+	if _, found := kapi.values[joinLockKey]; found {
+		t.Errorf("expected lock to be released")
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	kapi.values[joinLockKey] = "other"
+	if _, err := second.lock(timeout); err == nil {
+		t.Errorf("expected timeout waiting for a held lock")
+	}
+
+	report := &Report{}
+	dry, err := newJoinLock(kapi, time.Minute, "c", true, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dry.lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if kapi.values[joinLockKey] != "other" || len(report.Steps) != 1 {
+		t.Errorf("expected dry-run to only record a step, got %v", report.Steps)
+	}
+}
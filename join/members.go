@@ -0,0 +1,129 @@
+package join
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/glog"
+	"github.com/sttts/elastic-etcd/discovery"
+)
+
+// newClient returns an etcd client talking to the client urls of the given active
+// nodes.
+func newClient(cc ClientConfig, activeNodes []discovery.Machine) (client.Client, error) {
+	activeURLs := make([]string, 0, len(activeNodes))
+	for _, an := range activeNodes {
+		activeURLs = append(activeURLs, an.ClientURLs...)
+	}
+
+	return client.New(cc.etcdConfig(activeURLs, etcdTimeout))
+}
+
+// isSelf returns true if one of the member's peer urls is advertised by this instance.
+func isSelf(m client.Member, advertisedURLs []string) bool {
+	for _, u := range m.PeerURLs {
+		for _, au := range advertisedURLs {
+			if u == au {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// memberName returns the name of a member in the initial cluster. Unstarted members
+// have no name yet and are identified by their id, as are members which clash with
+// the name of this instance.
+func memberName(m client.Member, name string) string {
+	if m.Name == "" || m.Name == name {
+		return m.ID
+	}
+	return m.Name
+}
+
+// initialCluster returns the name=peerurl pairs of all members. The member of this
+// instance is named by name. Its peer urls are taken from the member list if it is
+// found there, from selfURLs otherwise.
+func initialCluster(members []client.Member, name string, advertisedURLs, selfURLs []string) []string {
+	self := []string{}
+	others := []string{}
+	for _, m := range members {
+		if isSelf(m, advertisedURLs) {
+			if len(self) == 0 {
+				for _, u := range m.PeerURLs {
+					self = append(self, fmt.Sprintf("%s=%s", name, u))
+				}
+				continue
+			}
+			glog.Warningf("Member %s with peer urls %v also overlaps with the advertised peer urls %v", m.ID, m.PeerURLs, advertisedURLs)
+		} else if m.Name == name {
+			glog.Warningf("Member %s with peer urls %v has the name %q of this instance", m.ID, m.PeerURLs, name)
+		}
+		n := memberName(m, name)
+		for _, u := range m.PeerURLs {
+			others = append(others, fmt.Sprintf("%s=%s", n, u))
+		}
+	}
+
+	if len(self) == 0 {
+		glog.Warningf("This instance with peer urls %v is not a member of the cluster", selfURLs)
+		for _, u := range selfURLs {
+			self = append(self, fmt.Sprintf("%s=%s", name, u))
+		}
+	}
+
+	return append(self, others...)
+}
+
+// reportMembershipMismatch logs discovery entries which are not cluster members and
+// cluster members which are not registered in the discovery service. It returns the
+// number of mismatches.
+func reportMembershipMismatch(nodes []discovery.Machine, members []client.Member) int {
+	key := func(urls []string) map[string]struct{} {
+		m := make(map[string]struct{}, len(urls))
+		for _, u := range urls {
+			m[u] = struct{}{}
+		}
+		return m
+	}
+	overlaps := func(a map[string]struct{}, urls []string) bool {
+		for _, u := range urls {
+			if _, found := a[u]; found {
+				return true
+			}
+		}
+		return false
+	}
+
+	mismatches := 0
+	for _, n := range nodes {
+		found := false
+		nodeURLs := key(n.PeerURLs)
+		for _, m := range members {
+			if overlaps(nodeURLs, m.PeerURLs) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			mismatches++
+			glog.Warningf("Discovery entry %s=%s is not a cluster member", n.Name, strings.Join(n.PeerURLs, ","))
+		}
+	}
+	for _, m := range members {
+		found := false
+		memberURLs := key(m.PeerURLs)
+		for _, n := range nodes {
+			if overlaps(memberURLs, n.PeerURLs) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			mismatches++
+			glog.Warningf("Member %s (%s) with peer urls %v is not registered in the discovery service", m.ID, m.Name, m.PeerURLs)
+		}
+	}
+	return mismatches
+}
@@ -0,0 +1,78 @@
+package join
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"github.com/sttts/elastic-etcd/discovery"
+	"golang.org/x/net/context"
+)
+
+func TestInitialCluster(t *testing.T) {
+	members := []client.Member{
+		{ID: "1", Name: "a", PeerURLs: []string{"http://10.0.0.1:2380"}},
+		{ID: "2", Name: "", PeerURLs: []string{"http://10.0.0.2:2380"}},
+		{ID: "3", Name: "", PeerURLs: []string{"http://10.0.0.3:2380"}},
+		{ID: "4", Name: "c", PeerURLs: []string{"http://10.0.0.4:2380"}},
+	}
+
+	tests := []struct {
+		name     string
+		selfURLs []string
+		expected []string
+	}{
+		{"c", []string{"http://10.0.0.3:2380"}, []string{
+			"c=http://10.0.0.3:2380",
+			"a=http://10.0.0.1:2380",
+			"2=http://10.0.0.2:2380",
+			"4=http://10.0.0.4:2380",
+		}},
+		{"d", []string{"http://10.0.0.5:2380"}, []string{
+			"d=http://10.0.0.5:2380",
+			"a=http://10.0.0.1:2380",
+			"2=http://10.0.0.2:2380",
+			"3=http://10.0.0.3:2380",
+			"c=http://10.0.0.4:2380",
+		}},
+	}
+	for _, test := range tests {
+		got := initialCluster(members, test.name, test.selfURLs, test.selfURLs)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("initialCluster for %q: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestReportMembershipMismatch(t *testing.T) {
+	nodes := []discovery.Machine{
+		{Member: client.Member{Name: "a", PeerURLs: []string{"http://10.0.0.1:2380"}}},
+		{Member: client.Member{Name: "b", PeerURLs: []string{"http://10.0.0.2:2380"}}},
+	}
+	members := []client.Member{
+		{ID: "1", Name: "a", PeerURLs: []string{"http://10.0.0.1:2380"}},
+		{ID: "3", Name: "c", PeerURLs: []string{"http://10.0.0.3:2380"}},
+	}
+	if n := reportMembershipMismatch(nodes, members); n != 2 {
+		t.Errorf("expected 2 mismatches, got %d", n)
+	}
+	if n := reportMembershipMismatch(nodes[:1], members[:1]); n != 0 {
+		t.Errorf("expected no mismatches, got %d", n)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	mapi := &fakeMembersAPI{members: []client.Member{
+		{ID: "1", Name: "a", PeerURLs: []string{"http://10.0.0.1:2380"}},
+		{ID: "2", PeerURLs: []string{"http://10.0.0.2:2380"}},
+		{ID: "3", Name: "c", PeerURLs: []string{"http://10.0.0.3:2380", "http://10.0.1.3:2380"}},
+	}}
+	cfg, err := proxy(context.Background(), mapi, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a=http://10.0.0.1:2380", "c=http://10.0.0.3:2380", "c=http://10.0.1.3:2380"}
+	if !reflect.DeepEqual(cfg.InitialCluster, expected) || cfg.Proxy != "on" || cfg.Name != "d" {
+		t.Errorf("expected proxy config with initial cluster %v, got %+v", expected, cfg)
+	}
+}
@@ -0,0 +1,210 @@
+package join
+
+import (
+	"fmt"
+
+	"github.com/coreos/etcd/client"
+	"github.com/sttts/elastic-etcd/discovery"
+	"golang.org/x/net/context"
+)
+
+// Action describes a step of the join algorithm.
+type Action string
+
+const (
+	// DiscoverAction is the cluster existence heuristic on the discovery entries.
+	DiscoverAction = Action("discover")
+
+	// LockAction acquires the cluster-wide join lock.
+	LockAction = Action("lock")
+
+	// ProbeMemberAction is the liveness check of a member, deciding whether it is dead.
+	ProbeMemberAction = Action("probe-member")
+
+	// RemoveMemberAction removes a dead member from the cluster.
+	RemoveMemberAction = Action("remove-member")
+
+	// DeleteDiscoveryAction removes the discovery entry of a dead member.
+	DeleteDiscoveryAction = Action("delete-discovery-entry")
+
+	// ProtectClusterAction is the quorum check before a member is added.
+	ProtectClusterAction = Action("protect-cluster")
+
+	// UpdateMemberAction replaces the peer urls of an existing member.
+	UpdateMemberAction = Action("update-member")
+
+	// AddMemberAction adds this instance as a new member to the cluster.
+	AddMemberAction = Action("add-member")
+
+	// AddDiscoveryAction publishes this instance in the discovery service.
+	AddDiscoveryAction = Action("add-discovery-entry")
+)
+
+// Observation is the liveness and leader state of a member as seen by the join algorithm.
+type Observation struct {
+	Name     string   `json:"name,omitempty"`
+	ID       string   `json:"id,omitempty"`
+	PeerURLs []string `json:"peerURLs"`
+	Alive    bool     `json:"alive"`
+	Active   bool     `json:"active"`
+	Leader   string   `json:"leader,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Step is a decision or an intended mutation of the join algorithm.
+type Step struct {
+	Action       Action        `json:"action"`
+	Name         string        `json:"name,omitempty"`
+	ID           string        `json:"id,omitempty"`
+	PeerURLs     []string      `json:"peerURLs,omitempty"`
+	Result       string        `json:"result,omitempty"`
+	Observations []Observation `json:"observations,omitempty"`
+}
+
+// Report is the machine-readable outcome of Plan.
+type Report struct {
+	Steps  []Step      `json:"steps"`
+	Config *EtcdConfig `json:"config,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// record appends a step. It is a no-op on a nil report.
+func (r *Report) record(s Step) {
+	if r == nil {
+		return
+	}
+	r.Steps = append(r.Steps, s)
+}
+
+// Plan runs the join algorithm like Join, but without mutating the cluster or the
+// discovery service. It returns the intended actions with the observations they rely on.
+// The report is also returned if the join would fail.
+func Plan(ctx context.Context, opts Options) (*Report, error) {
+	r := &Report{Steps: []Step{}}
+	cfg, err := join(ctx, opts, r)
+	r.Config = cfg
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r, err
+}
+
+// dryRunMembersAPI simulates member removal and addition on top of the real member
+// list, recording the mutations in the report.
+type dryRunMembersAPI struct {
+	client.MembersAPI
+	report  *Report
+	removed map[string]bool
+	added   []client.Member
+}
+
+func newDryRunMembersAPI(mapi client.MembersAPI, report *Report) *dryRunMembersAPI {
+	return &dryRunMembersAPI{
+		MembersAPI: mapi,
+		report:     report,
+		removed:    map[string]bool{},
+	}
+}
+
+func (d *dryRunMembersAPI) List(ctx context.Context) ([]client.Member, error) {
+	ms, err := d.MembersAPI.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]client.Member, 0, len(ms)+len(d.added))
+	for _, m := range ms {
+		if !d.removed[m.ID] {
+			result = append(result, m)
+		}
+	}
+	return append(result, d.added...), nil
+}
+
+func (d *dryRunMembersAPI) Add(ctx context.Context, peerURL string) (*client.Member, error) {
+	m := client.Member{
+		ID:       fmt.Sprintf("dry-run-%d", len(d.added)+1),
+		PeerURLs: []string{peerURL},
+	}
+	d.added = append(d.added, m)
+	d.report.record(Step{
+		Action:   AddMemberAction,
+		PeerURLs: m.PeerURLs,
+		Result:   "would add member",
+	})
+	return &m, nil
+}
+
+func (d *dryRunMembersAPI) Remove(ctx context.Context, id string) error {
+	ms, err := d.List(ctx)
+	if err != nil {
+		return err
+	}
+	s := Step{
+		Action: RemoveMemberAction,
+		ID:     id,
+		Result: "would remove member",
+	}
+	for _, m := range ms {
+		if m.ID == id {
+			s.Name = m.Name
+			s.PeerURLs = m.PeerURLs
+		}
+	}
+	d.removed[id] = true
+	d.report.record(s)
+	return nil
+}
+
+func (d *dryRunMembersAPI) Update(ctx context.Context, id string, peerURLs []string) error {
+	ms, err := d.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		if m.ID == id {
+			d.removed[id] = true
+			updated := m
+			updated.PeerURLs = peerURLs
+			d.added = append(d.added, updated)
+			d.report.record(Step{
+				Action:   UpdateMemberAction,
+				Name:     m.Name,
+				ID:       id,
+				PeerURLs: peerURLs,
+				Result:   fmt.Sprintf("would update peer urls from %v", m.PeerURLs),
+			})
+			return nil
+		}
+	}
+	return fmt.Errorf("member %s not found", id)
+}
+
+// dryRunBackend records discovery mutations in the report instead of executing them.
+type dryRunBackend struct {
+	discovery.Backend
+	report *Report
+}
+
+func (d *dryRunBackend) Add(ctx context.Context, m *discovery.Machine) (bool, error) {
+	d.report.record(Step{
+		Action:   AddDiscoveryAction,
+		Name:     m.Name,
+		ID:       m.ID,
+		PeerURLs: m.PeerURLs,
+		Result:   fmt.Sprintf("would add to discovery %v", d.Backend),
+	})
+	return true, nil
+}
+
+func (d *dryRunBackend) Delete(ctx context.Context, id string) (bool, error) {
+	d.report.record(Step{
+		Action: DeleteDiscoveryAction,
+		ID:     id,
+		Result: fmt.Sprintf("would delete from discovery %v", d.Backend),
+	})
+	return true, nil
+}
+
+func (d *dryRunBackend) String() string {
+	return fmt.Sprintf("%v", d.Backend)
+}
@@ -0,0 +1,73 @@
+package join
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	mapi := &fakeMembersAPI{}
+	backend := &flakyBackend{entries: map[string]bool{}}
+	for _, name := range []string{"a", "b", "c"} {
+		srv := newFakeEtcd("a")
+		defer srv.Close()
+		mapi.members = append(mapi.members, client.Member{
+			ID:         name,
+			Name:       name,
+			PeerURLs:   []string{srv.URL},
+			ClientURLs: []string{srv.URL},
+		})
+		backend.entries[name] = true
+	}
+	mapi.members = append(mapi.members, client.Member{
+		ID:         "d",
+		Name:       "d",
+		PeerURLs:   []string{"http://127.0.0.1:1"},
+		ClientURLs: []string{"http://127.0.0.1:1"},
+	})
+	backend.entries["d"] = true
+	members := append([]client.Member{}, mapi.members...)
+	kapi := &fakeKeysAPI{values: map[string]string{}}
+
+	report := &Report{}
+	opts := Options{Name: "e", Strategy: ReplaceStrategy, Fresh: true, JoinLockTTL: time.Minute}
+	ma, err := newMemberAdder(opts, 4, newDryRunMembersAPI(mapi, report), kapi, &dryRunBackend{Backend: backend, report: report}, nil, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ma.Add(ctx, "e", []string{"http://127.0.0.1:2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(mapi.members, members) {
+		t.Errorf("expected members to be unchanged, got %v", mapi.members)
+	}
+	if expected := map[string]bool{"a": true, "b": true, "c": true, "d": true}; !reflect.DeepEqual(backend.entries, expected) {
+		t.Errorf("expected discovery entries to be unchanged, got %v", backend.entries)
+	}
+	if len(kapi.values) != 0 {
+		t.Errorf("expected no lock or dead-since records, got %v", kapi.values)
+	}
+
+	var mutations []string
+	for _, s := range report.Steps {
+		switch s.Action {
+		case RemoveMemberAction, DeleteDiscoveryAction, UpdateMemberAction, AddMemberAction, AddDiscoveryAction:
+			mutations = append(mutations, string(s.Action)+" "+s.ID)
+		}
+	}
+	expected := []string{
+		"remove-member d",
+		"delete-discovery-entry d",
+		"add-member ",
+		"add-discovery-entry dry-run-1",
+	}
+	if !reflect.DeepEqual(mutations, expected) {
+		t.Errorf("expected steps %v, got %v", expected, mutations)
+	}
+}
@@ -0,0 +1,42 @@
+package join
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	mutationAttempts      = 4
+	mutationRetryInterval = time.Second
+)
+
+// jitter returns a random duration between d/2 and d, such that concurrent instances
+// spread out.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retry calls f up to attempts times with doubling pauses in between until it succeeds.
+// It is meant for idempotent mutations which follow a successful mutation of the other
+// source of truth, i.e. the cluster or the discovery service.
+func retry(ctx context.Context, what string, attempts int, interval time.Duration, f func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			glog.Warningf("Failed to %s, retrying in %v: %v", what, interval, err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(interval):
+			}
+			interval *= 2
+		}
+		if err = f(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,299 @@
+package join
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/coreos/etcd/client"
+)
+
+var (
+	// ErrClusterFull is returned if the cluster already has the target size.
+	ErrClusterFull = errors.New("cluster is already full")
+
+	// ErrNoDeadMember is returned by strategies which have to replace a dead member in
+	// a full cluster, but find none.
+	ErrNoDeadMember = errors.New("full cluster and no dead member")
+)
+
+// QuorumError is returned if adding or removing a member would put the quorum at risk,
+// or would leave the cluster with less than the minimal fault tolerance.
+type QuorumError struct {
+	// Arithmetic explains the quorum calculation.
+	Arithmetic string
+}
+
+func (e *QuorumError) Error() string {
+	return e.Arithmetic
+}
+
+// IsUnsafe returns true if joining was refused because it is not safe right now, i.e.
+// because the cluster is full, there is no dead member to replace or the quorum is at
+// risk. Joining might become safe later.
+func IsUnsafe(err error) bool {
+	if err == ErrClusterFull || err == ErrNoDeadMember {
+		return true
+	}
+	_, ok := err.(*QuorumError)
+	return ok
+}
+
+// Cluster is the state of an existing cluster a Decider bases its decision on.
+type Cluster struct {
+	// Members is the current member list, including unstarted members.
+	Members []client.Member
+
+	// Self is the unstarted member matching the peer urls of this instance, if any.
+	Self *client.Member
+
+	// Name and PeerURLs are the name and the advertised peer urls of this instance.
+	Name     string
+	PeerURLs []string
+
+	// Fresh is true if the etcd data directory of this instance is empty.
+	Fresh bool
+
+	// TargetSize is the maximum cluster size.
+	TargetSize int
+
+	observe      func(m client.Member) ([]Observation, bool)
+	observations map[string][]Observation
+	dead         map[string]bool
+}
+
+// Observations returns the liveness and leader observations of a member, one per peer
+// url. The member is probed on first use.
+func (c *Cluster) Observations(m client.Member) []Observation {
+	if c.observations == nil {
+		c.observations = map[string][]Observation{}
+	}
+	os, found := c.observations[m.ID]
+	if !found && c.observe != nil {
+		if c.dead == nil {
+			c.dead = map[string]bool{}
+		}
+		os, c.dead[m.ID] = c.observe(m)
+		c.observations[m.ID] = os
+	}
+	return os
+}
+
+// Dead returns true if no peer url of the member is alive and active, and the member
+// was dead for the configured number of probes and grace period. Members which could
+// not be checked are never considered dead.
+func (c *Cluster) Dead(m client.Member) bool {
+	os := c.Observations(m)
+	if dead, found := c.dead[m.ID]; found {
+		return dead
+	}
+	return probesDead(os)
+}
+
+// Decision is the outcome of a Decider.
+type Decision struct {
+	// Remove are the members to remove before adding this instance.
+	Remove []client.Member
+
+	// Add is true if this instance is to be added as a new member. If Cluster.Self is
+	// set, that member entry is used instead of adding another one. Add is only allowed
+	// if Cluster.Fresh is true, i.e. the data dir is empty. Otherwise the join fails.
+	Add bool
+
+	// Update is a member to take over by this instance with its data dir intact. Its
+	// peer urls are replaced by those of this instance.
+	Update *client.Member
+}
+
+// A Decider implements a join strategy: which members to remove and whether to add
+// this instance to an existing cluster. A Decider is also called when the data dir is
+// not fresh. Then it must not decide to add this instance, but may update a member.
+type Decider interface {
+	Decide(c *Cluster) (*Decision, error)
+}
+
+// A Passive Decider can tell beforehand that it will not change the cluster. Then the
+// join neither locks nor probes the cluster, but starts with the existing member list.
+type Passive interface {
+	Passive(fresh bool) bool
+}
+
+// passiveDecider is a Decider which never changes the cluster if the data dir is not
+// fresh, and with always set not at all.
+type passiveDecider struct {
+	Decider
+	always bool
+}
+
+// Passive returns true if the Decider will not change the cluster.
+func (d passiveDecider) Passive(fresh bool) bool {
+	return d.always || !fresh
+}
+
+// DeciderFunc is a function implementing a Decider.
+type DeciderFunc func(c *Cluster) (*Decision, error)
+
+// Decide calls f(c).
+func (f DeciderFunc) Decide(c *Cluster) (*Decision, error) {
+	return f(c)
+}
+
+var (
+	strategiesLock sync.Mutex
+	strategies     = map[Strategy]Decider{}
+)
+
+// RegisterStrategy makes a join strategy available under the given name.
+func RegisterStrategy(name Strategy, d Decider) {
+	strategiesLock.Lock()
+	defer strategiesLock.Unlock()
+
+	if _, found := strategies[name]; found {
+		panic(fmt.Sprintf("join strategy %q registered twice", name))
+	}
+	strategies[name] = d
+}
+
+// unregisterStrategy removes a join strategy. It is meant for tests only.
+func unregisterStrategy(name Strategy) {
+	strategiesLock.Lock()
+	defer strategiesLock.Unlock()
+
+	delete(strategies, name)
+}
+
+// Strategies returns the sorted names of all registered join strategies.
+func Strategies() []Strategy {
+	strategiesLock.Lock()
+	defer strategiesLock.Unlock()
+
+	names := make([]string, 0, len(strategies))
+	for n := range strategies {
+		names = append(names, string(n))
+	}
+	sort.Strings(names)
+
+	result := make([]Strategy, 0, len(names))
+	for _, n := range names {
+		result = append(result, Strategy(n))
+	}
+	return result
+}
+
+// decider returns the Decider of a registered join strategy.
+func decider(name Strategy) (Decider, error) {
+	strategiesLock.Lock()
+	defer strategiesLock.Unlock()
+
+	d, found := strategies[name]
+	if !found {
+		return nil, fmt.Errorf("unknown join strategy %q", name)
+	}
+	return d, nil
+}
+
+func init() {
+	RegisterStrategy(PreparedStrategy, passiveDecider{DeciderFunc(preparedDecider), true})
+	RegisterStrategy(AddStrategy, passiveDecider{DeciderFunc(addDecider), false})
+	RegisterStrategy(ReplaceStrategy, passiveDecider{DeciderFunc(replaceDecider), false})
+	RegisterStrategy(PruneStrategy, passiveDecider{DeciderFunc(pruneDecider), false})
+	RegisterStrategy(ReplaceByNameStrategy, DeciderFunc(replaceByNameDecider))
+}
+
+// preparedDecider never changes the cluster. The admin adds new members beforehand.
+func preparedDecider(c *Cluster) (*Decision, error) {
+	return &Decision{}, nil
+}
+
+// addDecider adds this instance, but never removes other members.
+func addDecider(c *Cluster) (*Decision, error) {
+	if !c.Fresh {
+		return &Decision{}, nil
+	}
+	return &Decision{Add: true}, nil
+}
+
+// replaceDecider removes one dead member if the cluster is full, then adds this instance.
+func replaceDecider(c *Cluster) (*Decision, error) {
+	if !c.Fresh {
+		return &Decision{}, nil
+	}
+	if c.Self != nil {
+		return &Decision{Add: true}, nil
+	}
+	if len(c.Members) < c.TargetSize {
+		return &Decision{Add: true}, nil
+	}
+	for _, m := range c.Members {
+		if c.Dead(m) {
+			return &Decision{Remove: []client.Member{m}, Add: true}, nil
+		}
+	}
+	return nil, ErrNoDeadMember
+}
+
+// pruneDecider removes all dead members, then adds this instance.
+func pruneDecider(c *Cluster) (*Decision, error) {
+	if !c.Fresh {
+		return &Decision{}, nil
+	}
+	if c.Self != nil {
+		return &Decision{Add: true}, nil
+	}
+	d := &Decision{Add: true}
+	for _, m := range c.Members {
+		if c.Dead(m) {
+			d.Remove = append(d.Remove, m)
+		}
+	}
+	return d, nil
+}
+
+// replaceByNameDecider takes over a dead member with the name of this instance. With the
+// data dir intact its peer urls are updated, otherwise it is removed and this instance
+// is added again. Without such a member it behaves like replace.
+func replaceByNameDecider(c *Cluster) (*Decision, error) {
+	var named *client.Member
+	for i := range c.Members {
+		if c.Members[i].Name == c.Name {
+			named = &c.Members[i]
+			break
+		}
+	}
+	if named == nil {
+		return replaceDecider(c)
+	}
+
+	if !c.Fresh {
+		if samePeerURLs(named.PeerURLs, c.PeerURLs) {
+			return &Decision{}, nil
+		}
+		if !c.Dead(*named) {
+			return nil, fmt.Errorf("member %s=%v with the name of this instance is alive", named.Name, named.PeerURLs)
+		}
+		return &Decision{Update: named}, nil
+	}
+
+	if !c.Dead(*named) {
+		return nil, fmt.Errorf("member %s=%v with the name of this instance is alive", named.Name, named.PeerURLs)
+	}
+	return &Decision{Remove: []client.Member{*named}, Add: true}, nil
+}
+
+// samePeerURLs returns true if both url lists contain the same urls.
+func samePeerURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	urls := make(map[string]struct{}, len(a))
+	for _, u := range a {
+		urls[u] = struct{}{}
+	}
+	for _, u := range b {
+		if _, found := urls[u]; !found {
+			return false
+		}
+	}
+	return true
+}
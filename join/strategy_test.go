@@ -0,0 +1,191 @@
+package join
+
+import (
+	"testing"
+
+	"github.com/coreos/etcd/client"
+)
+
+func TestBuiltinStrategies(t *testing.T) {
+	alive := []Observation{{Alive: true, Active: true}}
+	dead := []Observation{{}}
+	members := []client.Member{
+		{ID: "1", Name: "a"},
+		{ID: "2", Name: "b"},
+		{ID: "3", Name: "c"},
+	}
+	observations := map[string][]Observation{"1": alive, "2": dead, "3": dead}
+
+	tests := []struct {
+		strategy   Strategy
+		targetSize int
+		self       *client.Member
+		removed    []string
+		add        bool
+		err        bool
+	}{
+		{PreparedStrategy, 3, nil, nil, false, false},
+		{AddStrategy, 3, nil, nil, true, false},
+		{ReplaceStrategy, 5, nil, nil, true, false},
+		{ReplaceStrategy, 3, nil, []string{"2"}, true, false},
+		{ReplaceStrategy, 3, &client.Member{ID: "4"}, nil, true, false},
+		{PruneStrategy, 5, nil, []string{"2", "3"}, true, false},
+		{PruneStrategy, 3, &client.Member{ID: "4"}, nil, true, false},
+	}
+	for _, test := range tests {
+		d, err := decider(test.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decision, err := d.Decide(&Cluster{
+			Members:      members,
+			Self:         test.self,
+			Fresh:        true,
+			TargetSize:   test.targetSize,
+			observations: observations,
+		})
+		if (err != nil) != test.err {
+			t.Errorf("%s with target size %d: unexpected error %v", test.strategy, test.targetSize, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		removed := []string{}
+		for _, m := range decision.Remove {
+			removed = append(removed, m.ID)
+		}
+		if len(removed) != len(test.removed) || decision.Add != test.add {
+			t.Errorf("%s with target size %d: expected removal of %v and add=%v, got %v and add=%v",
+				test.strategy, test.targetSize, test.removed, test.add, removed, decision.Add)
+			continue
+		}
+		for i := range removed {
+			if removed[i] != test.removed[i] {
+				t.Errorf("%s with target size %d: expected removal of %v, got %v", test.strategy, test.targetSize, test.removed, removed)
+			}
+		}
+	}
+
+	observations["2"] = alive
+	observations["3"] = []Observation{{Alive: true, Error: "timeout"}}
+	d, _ := decider(ReplaceStrategy)
+	if _, err := d.Decide(&Cluster{Members: members, Fresh: true, TargetSize: 3, observations: observations}); err == nil {
+		t.Errorf("expected replace to fail on a full cluster without dead members")
+	}
+}
+
+func TestReplaceByNameStrategy(t *testing.T) {
+	members := []client.Member{
+		{ID: "1", Name: "a", PeerURLs: []string{"http://10.0.0.1:2380"}},
+		{ID: "2", Name: "b", PeerURLs: []string{"http://10.0.0.2:2380"}},
+	}
+	alive := []Observation{{Alive: true, Active: true}}
+	dead := []Observation{{}}
+
+	tests := []struct {
+		name     string
+		peerURLs []string
+		fresh    bool
+		bDead    bool
+		update   string
+		removed  string
+		add      bool
+		err      bool
+	}{
+		{"b", []string{"http://10.0.0.3:2380"}, false, true, "2", "", false, false},
+		{"b", []string{"http://10.0.0.2:2380"}, false, true, "", "", false, false},
+		{"b", []string{"http://10.0.0.3:2380"}, true, true, "", "2", true, false},
+		{"b", []string{"http://10.0.0.3:2380"}, true, false, "", "", false, true},
+		{"b", []string{"http://10.0.0.3:2380"}, false, false, "", "", false, true},
+		{"c", []string{"http://10.0.0.3:2380"}, true, false, "", "", true, false},
+	}
+	for i, test := range tests {
+		observations := map[string][]Observation{"1": alive, "2": alive}
+		if test.bDead {
+			observations["2"] = dead
+		}
+		d, err := decider(ReplaceByNameStrategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decision, err := d.Decide(&Cluster{
+			Members:      members,
+			Name:         test.name,
+			PeerURLs:     test.peerURLs,
+			Fresh:        test.fresh,
+			TargetSize:   3,
+			observations: observations,
+		})
+		if (err != nil) != test.err {
+			t.Errorf("%d: unexpected error %v", i, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		update := ""
+		if decision.Update != nil {
+			update = decision.Update.ID
+		}
+		removed := ""
+		for _, m := range decision.Remove {
+			removed += m.ID
+		}
+		if update != test.update || removed != test.removed || decision.Add != test.add {
+			t.Errorf("%d: expected update=%q, removed=%q, add=%v, got update=%q, removed=%q, add=%v",
+				i, test.update, test.removed, test.add, update, removed, decision.Add)
+		}
+	}
+}
+
+func TestPassiveStrategies(t *testing.T) {
+	for _, c := range []struct {
+		strategy       Strategy
+		fresh, passive bool
+	}{
+		{PreparedStrategy, true, true},
+		{PreparedStrategy, false, true},
+		{AddStrategy, true, false},
+		{AddStrategy, false, true},
+		{ReplaceStrategy, true, false},
+		{ReplaceStrategy, false, true},
+		{PruneStrategy, true, false},
+		{PruneStrategy, false, true},
+		{ReplaceByNameStrategy, true, false},
+		{ReplaceByNameStrategy, false, false},
+	} {
+		d, err := decider(c.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, ok := d.(Passive)
+		if passive := ok && p.Passive(c.fresh); passive != c.passive {
+			t.Errorf("%s with fresh=%v: expected passive=%v, got %v", c.strategy, c.fresh, c.passive, passive)
+		}
+	}
+}
+
+func TestRegisterStrategy(t *testing.T) {
+	RegisterStrategy("test-noop", DeciderFunc(func(c *Cluster) (*Decision, error) {
+		return &Decision{}, nil
+	}))
+	defer unregisterStrategy("test-noop")
+
+	found := false
+	for _, s := range Strategies() {
+		if s == "test-noop" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("registered strategy not found in %v", Strategies())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on duplicate registration")
+		}
+	}()
+	RegisterStrategy(AddStrategy, DeciderFunc(addDecider))
+}
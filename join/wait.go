@@ -0,0 +1,91 @@
+package join
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	waitMinBackoff = time.Second * 2
+	waitMaxBackoff = time.Minute
+)
+
+// safeJoiner re-evaluates a join which is not safe yet, compare IsUnsafe, with
+// exponential backoff until it becomes safe or the wait timeout passes.
+type safeJoiner struct {
+	join  func(ctx context.Context, opts Options) (*EtcdConfig, error)
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+	logf  func(format string, args ...interface{})
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func newSafeJoiner() *safeJoiner {
+	return &safeJoiner{
+		join: func(ctx context.Context, opts Options) (*EtcdConfig, error) {
+			return join(ctx, opts, nil)
+		},
+		now:        time.Now,
+		sleep:      sleep,
+		logf:       glog.Infof,
+		minBackoff: waitMinBackoff,
+		maxBackoff: waitMaxBackoff,
+	}
+}
+
+// sleep waits for the given duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// run joins, waiting up to opts.WaitTimeout for the join to become safe. The last
+// attempt is made at the deadline, and only that one falls back to opts.Fallback.
+func (w *safeJoiner) run(ctx context.Context, opts Options) (*EtcdConfig, error) {
+	if opts.WaitTimeout <= 0 {
+		return w.join(ctx, opts)
+	}
+
+	deadline := w.now().Add(opts.WaitTimeout)
+	waitOpts := opts
+	waitOpts.Fallback = NoFallback
+	backoff := w.minBackoff
+	for {
+		final := !w.now().Before(deadline)
+		attemptOpts := waitOpts
+		if final {
+			attemptOpts = opts
+		}
+
+		cfg, err := w.join(ctx, attemptOpts)
+		if !IsUnsafe(err) {
+			return cfg, err
+		}
+		if final {
+			glog.Warningf("Giving up waiting for a safe join after %v: %v", opts.WaitTimeout, err)
+			return nil, err
+		}
+
+		wait := jitter(backoff)
+		if remaining := deadline.Sub(w.now()); wait > remaining {
+			wait = remaining
+		}
+		w.logf("Joining is not safe yet, waiting %v: %v", wait, err)
+		if wait > 0 {
+			if err := w.sleep(ctx, wait); err != nil {
+				return nil, err
+			}
+		}
+		if backoff *= 2; backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package join
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var errNotUnsafe = errors.New("discovery unavailable")
+
+// fakeSafeJoiner returns a safeJoiner with a fake clock which advances on sleep. The
+// join func is called with the attempt number, counting from 1.
+func fakeSafeJoiner(join func(attempt int, opts Options) (*EtcdConfig, error)) (*safeJoiner, *[]time.Duration, *[]string) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	sleeps := []time.Duration{}
+	logs := []string{}
+	attempts := 0
+	return &safeJoiner{
+		join: func(ctx context.Context, opts Options) (*EtcdConfig, error) {
+			attempts++
+			return join(attempts, opts)
+		},
+		now: func() time.Time { return now },
+		sleep: func(ctx context.Context, d time.Duration) error {
+			sleeps = append(sleeps, d)
+			now = now.Add(d)
+			return nil
+		},
+		logf: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+		minBackoff: time.Second,
+		maxBackoff: 4 * time.Second,
+	}, &sleeps, &logs
+}
+
+func TestSafeJoiner(t *testing.T) {
+	ctx := context.Background()
+	member := &EtcdConfig{InitialClusterState: "existing"}
+	proxy := &EtcdConfig{Proxy: "on"}
+
+	tests := []struct {
+		name        string
+		fallback    Fallback
+		join        func(attempt int, opts Options) (*EtcdConfig, error)
+		expected    *EtcdConfig
+		expectedErr error
+		attempts    int
+	}{
+		{
+			"success after unsafe attempts", NoFallback,
+			func(attempt int, opts Options) (*EtcdConfig, error) {
+				if attempt <= 3 {
+					return nil, ErrClusterFull
+				}
+				return member, nil
+			},
+			member, nil, 4,
+		},
+		{
+			"timeout then error", NoFallback,
+			func(attempt int, opts Options) (*EtcdConfig, error) {
+				return nil, ErrNoDeadMember
+			},
+			nil, ErrNoDeadMember, -1,
+		},
+		{
+			"timeout then proxy fallback", ProxyFallback,
+			func(attempt int, opts Options) (*EtcdConfig, error) {
+				if opts.Fallback == ProxyFallback {
+					return proxy, nil
+				}
+				return nil, ErrClusterFull
+			},
+			proxy, nil, -1,
+		},
+		{
+			"other error returns immediately", ProxyFallback,
+			func(attempt int, opts Options) (*EtcdConfig, error) {
+				return nil, errNotUnsafe
+			},
+			nil, errNotUnsafe, 1,
+		},
+	}
+	for _, test := range tests {
+		attempts := 0
+		fallbacks := 0
+		w, sleeps, logs := fakeSafeJoiner(func(attempt int, opts Options) (*EtcdConfig, error) {
+			attempts = attempt
+			if opts.Fallback != NoFallback {
+				fallbacks++
+			}
+			return test.join(attempt, opts)
+		})
+
+		cfg, err := w.run(ctx, Options{WaitTimeout: 10 * time.Second, Fallback: test.fallback})
+		if cfg != test.expected || err != test.expectedErr {
+			t.Errorf("%s: expected %v, %v, got %v, %v", test.name, test.expected, test.expectedErr, cfg, err)
+		}
+		if test.attempts >= 0 && attempts != test.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.name, test.attempts, attempts)
+		}
+		if fallbacks > 1 {
+			t.Errorf("%s: expected the fallback to apply at most once, got %d", test.name, fallbacks)
+		}
+
+		var slept time.Duration
+		backoff := w.minBackoff
+		for i, d := range *sleeps {
+			if d > backoff {
+				t.Errorf("%s: sleep %d of %v exceeds backoff %v", test.name, i, d, backoff)
+			}
+			if backoff *= 2; backoff > w.maxBackoff {
+				backoff = w.maxBackoff
+			}
+			slept += d
+		}
+		if test.attempts < 0 && slept != 10*time.Second {
+			t.Errorf("%s: expected a final attempt at the deadline, slept %v", test.name, slept)
+		}
+		if len(*logs) != len(*sleeps) {
+			t.Errorf("%s: expected a log line per wait, got %v", test.name, *logs)
+		}
+		for _, l := range *logs {
+			if !strings.Contains(l, ErrClusterFull.Error()) && !strings.Contains(l, ErrNoDeadMember.Error()) {
+				t.Errorf("%s: expected the reason in %q", test.name, l)
+			}
+		}
+	}
+}
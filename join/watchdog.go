@@ -0,0 +1,136 @@
+package join
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const watchdogInterval = time.Second * 5
+
+// ErrMemberNotStarted is returned by Watchdog if the member of this instance did not
+// start before the deadline and was removed.
+var ErrMemberNotStarted = errors.New("member did not start before the deadline and was removed")
+
+// selfMember returns the member with one of the given peer urls, or nil.
+func selfMember(ctx context.Context, mapi client.MembersAPI, peerURLs []string) (*client.Member, error) {
+	ms, err := mapi.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range ms {
+		if isSelf(m, peerURLs) {
+			return &m, nil
+		}
+	}
+	return nil, nil
+}
+
+// Watchdog waits for the member of this instance, found by its advertised peer urls, to
+// start, i.e. to show up with a name in the member list. If it does not start before the
+// deadline, the member and its discovery entry are removed such that the unstarted
+// member does not count against the quorum forever.
+func Watchdog(ctx context.Context, opts Options, deadline time.Duration) error {
+	if len(opts.AdvertisePeerURLs) == 0 {
+		return errors.New("at least one advertised peer url is required")
+	}
+
+	nodes, err := opts.Backend.Machines(ctx)
+	if err != nil {
+		return err
+	}
+	c, err := newClient(opts.Client, nodes)
+	if err != nil {
+		return err
+	}
+	w := &watchdog{
+		mapi:          client.NewMembersAPI(c),
+		kapi:          client.NewKeysAPI(c),
+		interval:      watchdogInterval,
+		retryInterval: mutationRetryInterval,
+	}
+	return w.watch(ctx, opts, deadline)
+}
+
+// watchdog implements Watchdog on the given members and keys API.
+type watchdog struct {
+	mapi client.MembersAPI
+	kapi client.KeysAPI
+
+	interval      time.Duration
+	retryInterval time.Duration
+}
+
+func (w *watchdog) watch(ctx context.Context, opts Options, deadline time.Duration) error {
+	deadlineCtx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	for {
+		m, err := selfMember(deadlineCtx, w.mapi, opts.AdvertisePeerURLs)
+		if err != nil {
+			glog.Warningf("Cannot get cluster members: %v", err)
+		} else if m == nil {
+			glog.Infof("No member with peer urls %v found, nothing to watch", opts.AdvertisePeerURLs)
+			return nil
+		} else if m.Name != "" {
+			glog.Infof("Member %s=%v started", m.Name, m.PeerURLs)
+			return nil
+		}
+
+		select {
+		case <-deadlineCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			glog.Warningf("Member with peer urls %v did not start within %v", opts.AdvertisePeerURLs, deadline)
+			return w.removeUnstarted(ctx, opts)
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+// removeUnstarted removes the member of this instance and its discovery entry if it is
+// still unstarted.
+func (w *watchdog) removeUnstarted(ctx context.Context, opts Options) error {
+	l, err := newJoinLock(w.kapi, opts.JoinLockTTL, opts.Name, false, nil)
+	if err != nil {
+		return err
+	}
+	unlock, err := l.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m, err := selfMember(ctx, w.mapi, opts.AdvertisePeerURLs)
+	if err != nil {
+		return fmt.Errorf("cannot get cluster members: %v", err)
+	}
+	if m == nil || m.Name != "" {
+		return nil
+	}
+
+	if err := w.mapi.Remove(ctx, m.ID); err != nil {
+		return fmt.Errorf("couldn't remove unstarted member %s=%v: %v", m.ID, m.PeerURLs, err)
+	}
+	glog.Infof("Removed unstarted member %s=%v", m.ID, m.PeerURLs)
+
+	// the member is gone from the cluster, hence retry the idempotent delete
+	var found bool
+	err = retry(ctx, "remove unstarted member from discovery", mutationAttempts, w.retryInterval, func() error {
+		var err error
+		found, err = opts.Backend.Delete(ctx, m.ID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't remove unstarted member %s=%v from discovery %v: %v", m.ID, m.PeerURLs, opts.Backend, err)
+	}
+	if found {
+		glog.Infof("Unstarted member %s=%v removed from discovery %v", m.ID, m.PeerURLs, opts.Backend)
+	}
+
+	return ErrMemberNotStarted
+}
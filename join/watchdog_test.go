@@ -0,0 +1,40 @@
+package join
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func TestWatchdog(t *testing.T) {
+	ctx := context.Background()
+	urls := []string{"http://10.0.0.2:2380"}
+
+	tests := []struct {
+		name        string
+		member      client.Member
+		expectedErr error
+		members     int
+		entries     int
+	}{
+		{"started member", client.Member{ID: "2", Name: "b", PeerURLs: urls}, nil, 2, 2},
+		{"deadline expired", client.Member{ID: "2", PeerURLs: urls}, ErrMemberNotStarted, 1, 1},
+	}
+	for _, test := range tests {
+		mapi := &fakeMembersAPI{members: []client.Member{{ID: "1", Name: "a"}, test.member}}
+		// the first discovery delete fails, but is retried
+		backend := &flakyBackend{failures: 1, entries: map[string]bool{"1": true, "2": true}}
+		w := &watchdog{mapi: mapi, interval: time.Millisecond}
+
+		err := w.watch(ctx, Options{Name: "b", AdvertisePeerURLs: urls, Backend: backend}, 20*time.Millisecond)
+		if err != test.expectedErr {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expectedErr, err)
+		}
+		if len(mapi.members) != test.members || len(backend.entries) != test.entries {
+			t.Errorf("%s: expected %d members and %d discovery entries, got %v and %v",
+				test.name, test.members, test.entries, mapi.members, backend.entries)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package elastic
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/golang/glog"
+	"github.com/sttts/elastic-etcd/discovery"
+	"github.com/sttts/elastic-etcd/join"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultPromoteLockTTL is the join lock TTL of Promote if none is configured.
+	// Without the lock, multiple proxies could claim the same slot.
+	defaultPromoteLockTTL = time.Minute
+
+	// defaultPromoteUnstartedGrace is the unstarted member grace period of Promote if
+	// none is configured. Without it, another proxy could remove the member of a
+	// promoted proxy before its etcd has restarted.
+	defaultPromoteUnstartedGrace = time.Minute * 10
+)
+
+// proxyDir is the directory of the proxy state inside the etcd data dir.
+const proxyDir = "proxy"
+
+// Config is the typed input of the elastic-etcd algorithm. The command line only
+// populates it.
+type Config struct {
+	// Name is the cluster-unique node name.
+	Name string
+
+	// DataDir is the etcd data directory, by default <name>.etcd.
+	DataDir string
+
+	// JournalFile records membership changes in flight such that a rerun after a crash
+	// can resume them, by default <data-dir>.journal next to the data directory.
+	JournalFile string
+
+	// InitialAdvertisePeerURLs are the advertised peer urls of this instance.
+	InitialAdvertisePeerURLs []string
+
+	// AdvertiseClientURLs are published in the discovery service if given.
+	AdvertiseClientURLs []string
+
+	// ClientPort is the etcd client port of peers which do not publish their client urls.
+	ClientPort int
+
+	// ClusterSize is the maximum cluster size. If negative, the size value of the
+	// discovery url is used. Zero means unlimited.
+	ClusterSize int
+
+	// JoinStrategy is the strategy to join an existing cluster.
+	JoinStrategy join.Strategy
+
+	// DeadMemberGrace is the duration a member must be dead continuously before it
+	// may be removed.
+	DeadMemberGrace time.Duration
+
+	// UnstartedMemberGrace is the minimal grace period of unstarted members. Zero means
+	// DeadMemberGrace.
+	UnstartedMemberGrace time.Duration
+
+	// DeadMemberProbes is the number of consecutive failed probes before a member is
+	// considered dead. Zero means a single probe.
+	DeadMemberProbes int
+
+	// MaxRemovals caps the number of members removed in one run. Zero means no limit.
+	MaxRemovals int
+
+	// MinFaultTolerance is the number of member losses the cluster must tolerate after
+	// joining. Otherwise joining is refused.
+	MinFaultTolerance int
+
+	// JoinLockTTL is the TTL of the cluster-wide join lock. Zero disables the lock.
+	JoinLockTTL time.Duration
+
+	// Fallback is used if the instance cannot join because the cluster is full.
+	Fallback join.Fallback
+
+	// WaitTimeout is the time to wait for joining to become safe. Zero fails immediately.
+	WaitTimeout time.Duration
+
+	// DiscoveryURL is the discovery url. It is optional if SeedEndpoints are given.
+	DiscoveryURL string
+
+	// DiscoveryBackend is the name of the discovery backend. If empty, it is derived
+	// from the discovery url scheme.
+	DiscoveryBackend string
+
+	// Discovery configures the access to the discovery service. Its client port is
+	// overridden by ClientPort.
+	Discovery discovery.Config
+
+	// SeedEndpoints are client urls of an existing cluster to derive the members from.
+	SeedEndpoints []string
+
+	// PeerTLS and ClientTLS are the etcd TLS settings. They are also used for liveness
+	// probes and the members API.
+	PeerTLS   transport.TLSInfo
+	ClientTLS transport.TLSInfo
+
+	// Username and Password authenticate against the members API if v2 auth is enabled.
+	Username string
+	Password string
+}
+
+// Validate checks the config for consistency.
+func (cfg *Config) Validate() error {
+	if cfg.Name == "" {
+		return errors.New("name must be set")
+	}
+	if len(cfg.InitialAdvertisePeerURLs) == 0 {
+		return errors.New("initial-advertise-peer-urls must consist at least of one url")
+	}
+	if cfg.DiscoveryURL == "" && len(cfg.SeedEndpoints) == 0 {
+		return errors.New("discovery-url or seed-endpoints must be set")
+	}
+	if cfg.DiscoveryURL == "" && cfg.ClusterSize < 0 {
+		return errors.New("cluster-size must be set when using seed-endpoints without discovery url")
+	}
+
+	if (cfg.Discovery.TLS.CertFile == "") != (cfg.Discovery.TLS.KeyFile == "") {
+		return errors.New("discovery-cert-file and discovery-key-file must be given together")
+	}
+	if (cfg.PeerTLS.CertFile == "") != (cfg.PeerTLS.KeyFile == "") {
+		return errors.New("peer-cert-file and peer-key-file must be given together")
+	}
+	if (cfg.ClientTLS.CertFile == "") != (cfg.ClientTLS.KeyFile == "") {
+		return errors.New("cert-file and key-file must be given together")
+	}
+
+	if cfg.JournalFile != "" && strings.HasPrefix(filepath.Clean(cfg.JournalFile), filepath.Clean(cfg.dataDir())+string(filepath.Separator)) {
+		return errors.New("journal-file must not be inside the data-dir")
+	}
+	if cfg.Fallback != join.NoFallback && cfg.Fallback != join.ProxyFallback {
+		return fmt.Errorf("invalid fallback %q", cfg.Fallback)
+	}
+	if cfg.DeadMemberGrace < 0 {
+		return errors.New("dead-member-grace must not be negative")
+	}
+	if cfg.UnstartedMemberGrace < 0 {
+		return errors.New("unstarted-member-grace must not be negative")
+	}
+	if cfg.JoinLockTTL != 0 && cfg.JoinLockTTL < time.Second {
+		return errors.New("join-lock-ttl must be at least one second")
+	}
+	if cfg.DeadMemberProbes < 0 {
+		return errors.New("dead-member-probes must not be negative")
+	}
+	if cfg.MaxRemovals < 0 {
+		return errors.New("max-removals must not be negative")
+	}
+	if cfg.WaitTimeout < 0 {
+		return errors.New("wait-timeout must not be negative")
+	}
+	if cfg.MinFaultTolerance < 0 {
+		return errors.New("min-fault-tolerance must not be negative")
+	}
+
+	ok := cfg.DiscoveryBackend == ""
+	for _, b := range discovery.Backends() {
+		if b == cfg.DiscoveryBackend {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("invalid discovery backend %q", cfg.DiscoveryBackend)
+	}
+
+	ok = false
+	for _, s := range join.Strategies() {
+		if s == cfg.JoinStrategy {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("invalid join strategy %q", cfg.JoinStrategy)
+	}
+
+	return nil
+}
+
+// dataDir returns the etcd data directory, defaulting to <name>.etcd.
+func (cfg *Config) dataDir() string {
+	if cfg.DataDir == "" {
+		return cfg.Name + ".etcd"
+	}
+	return cfg.DataDir
+}
+
+// journalFile returns the journal file, defaulting to <data-dir>.journal.
+func (cfg *Config) journalFile() string {
+	if cfg.JournalFile == "" {
+		return filepath.Clean(cfg.dataDir()) + ".journal"
+	}
+	return cfg.JournalFile
+}
+
+// isProxyState returns true if the given data dir entries are the state of an etcd proxy.
+func isProxyState(fs []string) bool {
+	return len(fs) == 1 && fs[0] == proxyDir
+}
+
+// wipeProxyState removes the proxy state from the data dir such that etcd starts as a
+// member instead of resuming proxy operation.
+func (cfg *Config) wipeProxyState() error {
+	dataDir := cfg.dataDir()
+	if !fileutil.Exist(dataDir) {
+		return nil
+	}
+	fs, err := fileutil.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+	if !isProxyState(fs) {
+		return nil
+	}
+	glog.Infof("Wiping proxy state in %s", dataDir)
+	if err := os.RemoveAll(filepath.Join(dataDir, proxyDir)); err != nil {
+		return fmt.Errorf("cannot wipe proxy state: %v", err)
+	}
+	return nil
+}
+
+// joinOptions derives the options of the join algorithm, including the discovery backend
+// and the clients to talk to the cluster.
+func (cfg *Config) joinOptions() (*join.Options, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	dataDir := cfg.dataDir()
+	fresh := true
+	if fileutil.Exist(dataDir) {
+		fs, err := fileutil.ReadDir(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		glog.V(6).Infof("Found the following files in %s: %v", dataDir, fs)
+		// the state of a proxy does not make a member, it is wiped when promoted
+		fresh = len(fs) == 0 || isProxyState(fs)
+	}
+
+	probe, err := discovery.Config{
+		TLS:   cfg.PeerTLS,
+		Proxy: cfg.Discovery.Proxy,
+	}.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	clientTransport, err := transport.NewTransport(cfg.ClientTLS, etcdDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var backend discovery.Backend
+	if cfg.DiscoveryURL != "" {
+		discoveryConfig := cfg.Discovery
+		discoveryConfig.ClientPort = cfg.ClientPort
+		backend, err = discovery.NewBackend(cfg.DiscoveryBackend, cfg.DiscoveryURL, discoveryConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.SeedEndpoints) > 0 {
+		backend, err = discovery.NewSeedBackend(client.Config{
+			Endpoints: cfg.SeedEndpoints,
+			Transport: clientTransport,
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+		}, backend)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &join.Options{
+		Backend:              backend,
+		Name:                 cfg.Name,
+		AdvertisePeerURLs:    cfg.InitialAdvertisePeerURLs,
+		AdvertiseClientURLs:  cfg.AdvertiseClientURLs,
+		Fresh:                fresh,
+		ClientPort:           cfg.ClientPort,
+		ClusterSize:          cfg.ClusterSize,
+		Strategy:             cfg.JoinStrategy,
+		DeadMemberGrace:      cfg.DeadMemberGrace,
+		UnstartedMemberGrace: cfg.UnstartedMemberGrace,
+		DeadMemberProbes:     cfg.DeadMemberProbes,
+		MaxRemovals:          cfg.MaxRemovals,
+		MinFaultTolerance:    cfg.MinFaultTolerance,
+		WaitTimeout:          cfg.WaitTimeout,
+		JoinLockTTL:          cfg.JoinLockTTL,
+		JournalPath:          cfg.journalFile(),
+		Fallback:             cfg.Fallback,
+		Client: join.ClientConfig{
+			Probe:     probe,
+			Transport: clientTransport,
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+		},
+	}, nil
+}
+
+// Join runs the elastic-etcd algorithm and returns the resulting etcd configuration.
+func Join(ctx context.Context, cfg Config) (*EtcdConfig, error) {
+	opts, err := cfg.joinOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	jr, err := join.Join(ctx, *opts)
+	if join.IsUnsafe(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cluster join failed: %v", err)
+	}
+	if jr.Proxy == "" {
+		if err := cfg.wipeProxyState(); err != nil {
+			return nil, err
+		}
+	}
+	return &EtcdConfig{
+		EtcdConfig: *jr,
+		DataDir:    cfg.dataDir(),
+		PeerTLS:    cfg.PeerTLS,
+		ClientTLS:  cfg.ClientTLS,
+	}, nil
+}
+
+// Plan runs the elastic-etcd algorithm without mutating the cluster or the discovery
+// service and returns the intended actions. The report is also returned if the join
+// would fail.
+func Plan(ctx context.Context, cfg Config) (*join.Report, error) {
+	opts, err := cfg.joinOptions()
+	if err != nil {
+		return nil, err
+	}
+	return join.Plan(ctx, *opts)
+}
+
+// Watchdog waits for the member of this instance to start. If it does not start before
+// the deadline, the member and its discovery entry are removed and
+// join.ErrMemberNotStarted is returned.
+func Watchdog(ctx context.Context, cfg Config, deadline time.Duration) error {
+	opts, err := cfg.joinOptions()
+	if err != nil {
+		return err
+	}
+	return join.Watchdog(ctx, *opts, deadline)
+}
+
+// Promote waits until this proxy instance can join the cluster as a full member, either
+// because the cluster is below its size or because the join strategy removes a member
+// which is dead long enough. The join lock serializes concurrent proxies. The unstarted
+// member of a promoted proxy occupies its slot until its etcd has started, protected by
+// the unstarted member grace period, by default defaultPromoteUnstartedGrace. On
+// success the proxy state is wiped and the member config is returned, such that etcd can
+// be restarted as a member.
+func Promote(ctx context.Context, cfg Config, interval time.Duration) (*EtcdConfig, error) {
+	return promote(ctx, cfg, interval, Join)
+}
+
+// promote implements Promote with the given join func.
+func promote(
+	ctx context.Context,
+	cfg Config,
+	interval time.Duration,
+	joinFunc func(context.Context, Config) (*EtcdConfig, error),
+) (*EtcdConfig, error) {
+	cfg.Fallback = join.NoFallback
+	if cfg.JoinLockTTL == 0 {
+		glog.Infof("Using a join lock TTL of %v for promotion", defaultPromoteLockTTL)
+		cfg.JoinLockTTL = defaultPromoteLockTTL
+	}
+	if cfg.UnstartedMemberGrace == 0 {
+		glog.Infof("Using an unstarted member grace period of %v for promotion", defaultPromoteUnstartedGrace)
+		cfg.UnstartedMemberGrace = defaultPromoteUnstartedGrace
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	dataDir := cfg.dataDir()
+	if fileutil.Exist(dataDir) {
+		fs, err := fileutil.ReadDir(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(fs) > 0 && !isProxyState(fs) {
+			return nil, fmt.Errorf("%s does not contain proxy state, nothing to promote", dataDir)
+		}
+	}
+
+	for {
+		ec, err := joinFunc(ctx, cfg)
+		if err == nil {
+			glog.Infof("Promoted to member %q", cfg.Name)
+			return ec, nil
+		}
+		if join.IsUnsafe(err) {
+			glog.V(4).Infof("Cannot be promoted yet: %v", err)
+		} else {
+			glog.Warningf("Promotion failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package elastic
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sttts/elastic-etcd/join"
+	"golang.org/x/net/context"
+)
+
+func TestIsProxyState(t *testing.T) {
+	tests := []struct {
+		fs       []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{"proxy"}, true},
+		{[]string{"member"}, false},
+		{[]string{"member", "proxy"}, false},
+	}
+	for _, test := range tests {
+		if got := isProxyState(test.fs); got != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.fs, test.expected, got)
+		}
+	}
+}
+
+func TestWipeProxyState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elastic-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{Name: "a", DataDir: filepath.Join(dir, "data")}
+	if err := cfg.wipeProxyState(); err != nil {
+		t.Errorf("unexpected error for a missing data dir: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(cfg.DataDir, "proxy"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.wipeProxyState(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, "proxy")); !os.IsNotExist(err) {
+		t.Errorf("expected proxy state to be wiped, got %v", err)
+	}
+
+	for _, d := range []string{"member", "proxy"} {
+		if err := os.MkdirAll(filepath.Join(cfg.DataDir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cfg.wipeProxyState(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, "proxy")); err != nil {
+		t.Errorf("expected the data dir of a member to stay untouched, got %v", err)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elastic-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		Name:                     "a",
+		DataDir:                  filepath.Join(dir, "a.etcd"),
+		InitialAdvertisePeerURLs: []string{"http://10.0.0.1:2380"},
+		DiscoveryURL:             "https://discovery.etcd.io/token",
+		JoinStrategy:             join.ReplaceStrategy,
+		Fallback:                 join.ProxyFallback,
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.DataDir, "proxy"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	calls := 0
+	errs := []error{join.ErrClusterFull, errors.New("discovery unavailable"), join.ErrNoDeadMember}
+	ec, err := promote(ctx, cfg, time.Millisecond, func(ctx context.Context, cfg Config) (*EtcdConfig, error) {
+		if cfg.Fallback != join.NoFallback || cfg.JoinLockTTL == 0 || cfg.UnstartedMemberGrace == 0 {
+			t.Errorf("expected no fallback, a join lock and an unstarted member grace period, got %q, %v and %v",
+				cfg.Fallback, cfg.JoinLockTTL, cfg.UnstartedMemberGrace)
+		}
+		if calls++; calls <= len(errs) {
+			return nil, errs[calls-1]
+		}
+		return &EtcdConfig{DataDir: cfg.DataDir}, nil
+	})
+	if err != nil || ec == nil {
+		t.Fatalf("expected promotion, got %v", err)
+	}
+	if calls != len(errs)+1 {
+		t.Errorf("expected %d attempts, got %d", len(errs)+1, calls)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = promote(timeout, cfg, time.Millisecond, func(ctx context.Context, cfg Config) (*EtcdConfig, error) {
+		return nil, join.ErrClusterFull
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(cfg.DataDir, "member"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	_, err = promote(ctx, cfg, time.Millisecond, func(ctx context.Context, cfg Config) (*EtcdConfig, error) {
+		t.Errorf("expected no join attempt of a member")
+		return nil, nil
+	})
+	if err == nil {
+		t.Errorf("expected error for a data dir with member state")
+	}
+}
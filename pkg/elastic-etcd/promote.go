@@ -0,0 +1,34 @@
+package elastic
+
+import (
+	"time"
+
+	"github.com/codegangsta/cli"
+	"golang.org/x/net/context"
+)
+
+func promoteCommand(config func() (*Config, error), result **EtcdConfig) cli.Command {
+	var interval time.Duration
+
+	return cli.Command{
+		Name:  "promote",
+		Usage: "wait as proxy until a slot in the cluster is free, then join as member and output its config",
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:        "interval",
+				Usage:       "the time between two membership health checks",
+				EnvVar:      "ELASTIC_ETCD_PROMOTE_INTERVAL",
+				Value:       30 * time.Second,
+				Destination: &interval,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := config()
+			if err != nil {
+				return err
+			}
+			*result, err = Promote(context.Background(), *cfg, interval)
+			return err
+		},
+	}
+}
@@ -1,23 +1,39 @@
 package elastic
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"net/url"
+	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
-	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/pkg/transport"
 	"github.com/golang/glog"
 	"github.com/sttts/elastic-etcd/cliext"
+	"github.com/sttts/elastic-etcd/discovery"
 	"github.com/sttts/elastic-etcd/join"
+	"golang.org/x/net/context"
 )
 
+const etcdDialTimeout = time.Second * 30
+
+// splitURLs splits a comma separated list of urls. An empty string gives nil.
+func splitURLs(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 // EtcdConfig is the result of the elastic-etcd algorithm, turned into etcd flags or env vars.
 type EtcdConfig struct {
 	join.EtcdConfig
-	DataDir string
+	DataDir   string
+	PeerTLS   transport.TLSInfo
+	ClientTLS transport.TLSInfo
 }
 
 // Flags turns an EtcdConfig struct into etcd flags.
@@ -32,9 +48,34 @@ func (r *EtcdConfig) Flags() []string {
 	if r.Discovery != "" {
 		args = append(args, fmt.Sprintf("-discovery=%s", r.Discovery))
 	}
+	if r.DiscoverySRV != "" {
+		args = append(args, fmt.Sprintf("-discovery-srv=%s", r.DiscoverySRV))
+	}
 	if r.AdvertisePeerURLs != "" {
 		args = append(args, fmt.Sprintf("-initial-advertise-peer-urls=%s", r.AdvertisePeerURLs))
 	}
+	if r.Proxy != "" {
+		args = append(args, fmt.Sprintf("-proxy=%s", r.Proxy))
+	}
+
+	if r.PeerTLS.CertFile != "" {
+		args = append(args, fmt.Sprintf("-peer-cert-file=%s", r.PeerTLS.CertFile))
+	}
+	if r.PeerTLS.KeyFile != "" {
+		args = append(args, fmt.Sprintf("-peer-key-file=%s", r.PeerTLS.KeyFile))
+	}
+	if r.PeerTLS.TrustedCAFile != "" {
+		args = append(args, fmt.Sprintf("-peer-trusted-ca-file=%s", r.PeerTLS.TrustedCAFile))
+	}
+	if r.ClientTLS.CertFile != "" {
+		args = append(args, fmt.Sprintf("-cert-file=%s", r.ClientTLS.CertFile))
+	}
+	if r.ClientTLS.KeyFile != "" {
+		args = append(args, fmt.Sprintf("-key-file=%s", r.ClientTLS.KeyFile))
+	}
+	if r.ClientTLS.TrustedCAFile != "" {
+		args = append(args, fmt.Sprintf("-trusted-ca-file=%s", r.ClientTLS.TrustedCAFile))
+	}
 
 	args = append(args, fmt.Sprintf("-name=%s", r.Name))
 	args = append(args, fmt.Sprintf("-data-dir=%s", r.DataDir))
@@ -48,42 +89,49 @@ func (r *EtcdConfig) Flags() []string {
 func Run(args []string) (*EtcdConfig, string, error) {
 	var (
 		discoveryURL             string
+		discoveryBackend         string
+		discoveryUsername        string
+		discoveryPassword        string
+		discoveryCAFile          string
+		discoveryCertFile        string
+		discoveryKeyFile         string
+		discoveryServerName      string
+		discoveryProxy           string
+		peerTLS                  transport.TLSInfo
+		clientTLS                transport.TLSInfo
+		username                 string
+		password                 string
+		passwordFile             string
+		seedEndpoints            string
 		joinStrategy             string
 		format                   string
 		name                     string
 		clientPort               int
 		clusterSize              int
 		initialAdvertisePeerURLs string
+		advertiseClientURLs      string
 		dataDir                  string
+		dryRun                   bool
+		deadMemberGrace          time.Duration
+		unstartedMemberGrace     time.Duration
+		deadMemberProbes         int
+		maxRemovals              int
+		minFaultTolerance        int
+		waitTimeout              time.Duration
+		joinLockTTL              time.Duration
+		journalFile              string
+		fallback                 string
 	)
 
 	var formats = []string{"env", "dropin", "flags"}
-	var strategies = []string{
-		string(join.PreparedStrategy),
-		string(join.ReplaceStrategy),
-		string(join.PruneStrategy),
-		string(join.AddStrategy),
+	strategyNames := []string{}
+	for _, s := range join.Strategies() {
+		strategyNames = append(strategyNames, string(s))
 	}
 
 	checkFlags := func() error {
-		if name == "" {
-			return errors.New("name must be set")
-		}
-		if initialAdvertisePeerURLs == "" {
-			return errors.New("initial-advertise-peer-urls must consist at least of one url")
-		}
-		if discoveryURL == "" {
-			return errors.New("discovery-url must be set")
-		}
-
-		discoveryURL = strings.TrimRight(discoveryURL, "/")
-
-		u, err := url.Parse(discoveryURL)
-		if err != nil {
-			return fmt.Errorf("invalid discovery url %q: %v", discoveryURL, err)
-		}
-		if u.Scheme != "http" && u.Scheme != "https" {
-			return errors.New("discovery url must use http or https scheme")
+		if password != "" && passwordFile != "" {
+			return errors.New("only one of password and password-file can be given")
 		}
 
 		ok := false
@@ -97,17 +145,6 @@ func Run(args []string) (*EtcdConfig, string, error) {
 			return fmt.Errorf("invalid output format %q", format)
 		}
 
-		ok = false
-		for _, s := range strategies {
-			if s == joinStrategy {
-				ok = true
-				break
-			}
-		}
-		if !ok {
-			return fmt.Errorf("invalid join strategy %q", joinStrategy)
-		}
-
 		return nil
 	}
 
@@ -124,13 +161,132 @@ func Run(args []string) (*EtcdConfig, string, error) {
 			Destination: &discoveryURL,
 			EnvVar:      "ELASTIC_ETCD_DISCOVERY",
 		},
+		cli.StringFlag{
+			Name:        "discovery-backend",
+			Value:       "",
+			Usage:       "the discovery backend out of: " + strings.Join(discovery.Backends(), ", ") + ", default: derived from the discovery url scheme",
+			Destination: &discoveryBackend,
+			EnvVar:      "ELASTIC_ETCD_DISCOVERY_BACKEND",
+		},
+		cli.StringFlag{
+			Name:        "discovery-username",
+			Value:       "",
+			Usage:       "the username to authenticate against the discovery service",
+			Destination: &discoveryUsername,
+			EnvVar:      "ELASTIC_ETCD_DISCOVERY_USERNAME",
+		},
+		cli.StringFlag{
+			Name:        "discovery-password",
+			Value:       "",
+			Usage:       "the password to authenticate against the discovery service",
+			Destination: &discoveryPassword,
+			EnvVar:      "ELASTIC_ETCD_DISCOVERY_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:        "discovery-ca-file",
+			Value:       "",
+			Usage:       "the CA bundle to verify the discovery service certificate",
+			Destination: &discoveryCAFile,
+			EnvVar:      "ELASTIC_ETCD_DISCOVERY_CA_FILE",
+		},
+		cli.StringFlag{
+			Name:        "discovery-cert-file",
+			Value:       "",
+			Usage:       "the client certificate for the discovery service",
+			Destination: &discoveryCertFile,
+			EnvVar:      "ELASTIC_ETCD_DISCOVERY_CERT_FILE",
+		},
+		cli.StringFlag{
+			Name:        "discovery-key-file",
+			Value:       "",
+			Usage:       "the client key for the discovery service",
+			Destination: &discoveryKeyFile,
+			EnvVar:      "ELASTIC_ETCD_DISCOVERY_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:        "discovery-server-name",
+			Value:       "",
+			Usage:       "the server name to verify the discovery service certificate against, default: the url host",
+			Destination: &discoveryServerName,
+			EnvVar:      "ELASTIC_ETCD_DISCOVERY_SERVER_NAME",
+		},
+		cli.StringFlag{
+			Name:        "discovery-proxy",
+			Value:       "",
+			Usage:       "the HTTP(S) proxy url for discovery requests and liveness probes, default: from the environment",
+			Destination: &discoveryProxy,
+			EnvVar:      "ELASTIC_ETCD_DISCOVERY_PROXY",
+		},
+		cli.StringFlag{
+			Name:        "seed-endpoints",
+			Value:       "",
+			Usage:       "comma separated client urls of an existing cluster to derive the members from instead of the discovery url",
+			Destination: &seedEndpoints,
+			EnvVar:      "ELASTIC_ETCD_SEED_ENDPOINTS",
+		},
 		cli.StringFlag{
 			Name:        "join-strategy",
-			Usage:       "the strategy to join: " + strings.Join(strategies, ", "),
+			Usage:       "the strategy to join: " + strings.Join(strategyNames, ", "),
 			EnvVar:      "ELASTIC_ETCD_JOIN_STRATEGY",
 			Value:       string(join.ReplaceStrategy),
 			Destination: &joinStrategy,
 		},
+		cli.DurationFlag{
+			Name:        "dead-member-grace",
+			Usage:       "the duration a member must be observed dead, with observations at most the grace period apart, before it may be removed, recorded in the cluster keyspace",
+			EnvVar:      "ELASTIC_ETCD_DEAD_MEMBER_GRACE",
+			Value:       0,
+			Destination: &deadMemberGrace,
+		},
+		cli.DurationFlag{
+			Name:        "unstarted-member-grace",
+			Usage:       "the minimal grace period of unstarted members, e.g. of concurrent joiners whose etcd has not started yet, 0 for the dead-member-grace",
+			EnvVar:      "ELASTIC_ETCD_UNSTARTED_MEMBER_GRACE",
+			Value:       0,
+			Destination: &unstartedMemberGrace,
+		},
+		cli.IntFlag{
+			Name:        "dead-member-probes",
+			Usage:       "the number of consecutive failed probes before a member is considered dead",
+			EnvVar:      "ELASTIC_ETCD_DEAD_MEMBER_PROBES",
+			Value:       1,
+			Destination: &deadMemberProbes,
+		},
+		cli.IntFlag{
+			Name:        "max-removals",
+			Usage:       "the maximum number of members removed in one run, 0 for no limit",
+			EnvVar:      "ELASTIC_ETCD_MAX_REMOVALS",
+			Value:       0,
+			Destination: &maxRemovals,
+		},
+		cli.IntFlag{
+			Name:        "min-fault-tolerance",
+			Usage:       "the number of member losses the cluster must tolerate after joining, otherwise joining is refused",
+			EnvVar:      "ELASTIC_ETCD_MIN_FAULT_TOLERANCE",
+			Value:       0,
+			Destination: &minFaultTolerance,
+		},
+		cli.DurationFlag{
+			Name:        "wait-timeout",
+			Usage:       "the time to wait with backoff while joining is not safe, e.g. the cluster is full or the quorum at risk, 0 to fail immediately",
+			EnvVar:      "ELASTIC_ETCD_WAIT_TIMEOUT",
+			Value:       0,
+			Destination: &waitTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "join-lock-ttl",
+			Usage:       "the TTL of a lock in the cluster keyspace serializing concurrent joiners, 0 to disable",
+			EnvVar:      "ELASTIC_ETCD_JOIN_LOCK_TTL",
+			Value:       0,
+			Destination: &joinLockTTL,
+		},
+		cli.StringFlag{
+			Name:        "fallback",
+			Usage:       "what to do if the cluster is full: empty to fail, or proxy to run etcd as a proxy",
+			EnvVar:      "ELASTIC_ETCD_FALLBACK",
+			Value:       "",
+			Destination: &fallback,
+		},
 		cli.StringFlag{
 			Name:        "data-dir",
 			Usage:       "the etcd data directory",
@@ -138,6 +294,13 @@ func Run(args []string) (*EtcdConfig, string, error) {
 			Value:       "",
 			Destination: &dataDir,
 		},
+		cli.StringFlag{
+			Name:        "journal-file",
+			Usage:       "the file recording membership changes in flight, default: <data-dir>.journal",
+			EnvVar:      "ELASTIC_ETCD_JOURNAL_FILE",
+			Value:       "",
+			Destination: &journalFile,
+		},
 		cli.StringFlag{
 			Name:        "o",
 			Usage:       fmt.Sprintf("the output format out of: %s", strings.Join(formats, ", ")),
@@ -153,7 +316,7 @@ func Run(args []string) (*EtcdConfig, string, error) {
 		},
 		cli.IntFlag{
 			Name:        "client-port",
-			Usage:       "the etcd client port of all peers",
+			Usage:       "the etcd client port of peers which do not publish their client urls",
 			EnvVar:      "ELASTIC_ETCD_CLIENT_PORT",
 			Value:       2379,
 			Destination: &clientPort,
@@ -172,6 +335,142 @@ func Run(args []string) (*EtcdConfig, string, error) {
 			Value:       "http://localhost:2380",
 			Destination: &initialAdvertisePeerURLs,
 		},
+		cli.StringFlag{
+			Name:        "advertise-client-urls",
+			Usage:       "the advertised client urls of this instance, published in the discovery service",
+			EnvVar:      "ELASTIC_ETCD_ADVERTISE_CLIENT_URLS",
+			Value:       "",
+			Destination: &advertiseClientURLs,
+		},
+		cli.StringFlag{
+			Name:        "peer-cert-file",
+			Usage:       "the peer server TLS cert file, also used for liveness probes",
+			EnvVar:      "ELASTIC_ETCD_PEER_CERT_FILE",
+			Value:       "",
+			Destination: &peerTLS.CertFile,
+		},
+		cli.StringFlag{
+			Name:        "peer-key-file",
+			Usage:       "the peer server TLS key file, also used for liveness probes",
+			EnvVar:      "ELASTIC_ETCD_PEER_KEY_FILE",
+			Value:       "",
+			Destination: &peerTLS.KeyFile,
+		},
+		cli.StringFlag{
+			Name:        "peer-trusted-ca-file",
+			Usage:       "the peer server TLS trusted CA file, also used for liveness probes",
+			EnvVar:      "ELASTIC_ETCD_PEER_TRUSTED_CA_FILE",
+			Value:       "",
+			Destination: &peerTLS.TrustedCAFile,
+		},
+		cli.StringFlag{
+			Name:        "cert-file",
+			Usage:       "the client server TLS cert file, also used for the members API",
+			EnvVar:      "ELASTIC_ETCD_CERT_FILE",
+			Value:       "",
+			Destination: &clientTLS.CertFile,
+		},
+		cli.StringFlag{
+			Name:        "key-file",
+			Usage:       "the client server TLS key file, also used for the members API",
+			EnvVar:      "ELASTIC_ETCD_KEY_FILE",
+			Value:       "",
+			Destination: &clientTLS.KeyFile,
+		},
+		cli.StringFlag{
+			Name:        "trusted-ca-file",
+			Usage:       "the client server TLS trusted CA file, also used for the members API",
+			EnvVar:      "ELASTIC_ETCD_TRUSTED_CA_FILE",
+			Value:       "",
+			Destination: &clientTLS.TrustedCAFile,
+		},
+		cli.StringFlag{
+			Name:        "username",
+			Usage:       "the username for the members API if etcd v2 auth is enabled",
+			EnvVar:      "ELASTIC_ETCD_USERNAME",
+			Value:       "",
+			Destination: &username,
+		},
+		cli.StringFlag{
+			Name:        "password",
+			Usage:       "the password for the members API, prefer the environment variable or password-file",
+			EnvVar:      "ELASTIC_ETCD_PASSWORD",
+			Value:       "",
+			Destination: &password,
+		},
+		cli.StringFlag{
+			Name:        "password-file",
+			Usage:       "a file to read the password for the members API from",
+			EnvVar:      "ELASTIC_ETCD_PASSWORD_FILE",
+			Value:       "",
+			Destination: &passwordFile,
+		},
+		cli.BoolFlag{
+			Name:        "dry-run",
+			Usage:       "print the intended join actions as JSON without changing the cluster or the discovery service",
+			EnvVar:      "ELASTIC_ETCD_DRY_RUN",
+			Destination: &dryRun,
+		},
+	}
+
+	// config validates the flags and turns them into a Config
+	config := func() (*Config, error) {
+		err := checkFlags()
+		if err != nil {
+			return nil, err
+		}
+
+		// derive configuration values
+		if passwordFile != "" {
+			bs, err := ioutil.ReadFile(passwordFile)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read password file: %v", err)
+			}
+			password = strings.TrimRight(string(bs), "\r\n")
+		}
+		return &Config{
+			Name:                     name,
+			DataDir:                  dataDir,
+			JournalFile:              journalFile,
+			InitialAdvertisePeerURLs: splitURLs(initialAdvertisePeerURLs),
+			AdvertiseClientURLs:      splitURLs(advertiseClientURLs),
+			ClientPort:               clientPort,
+			ClusterSize:              clusterSize,
+			JoinStrategy:             join.Strategy(joinStrategy),
+			DeadMemberGrace:          deadMemberGrace,
+			UnstartedMemberGrace:     unstartedMemberGrace,
+			DeadMemberProbes:         deadMemberProbes,
+			MaxRemovals:              maxRemovals,
+			MinFaultTolerance:        minFaultTolerance,
+			WaitTimeout:              waitTimeout,
+			JoinLockTTL:              joinLockTTL,
+			Fallback:                 join.Fallback(fallback),
+			DiscoveryURL:             strings.TrimRight(discoveryURL, "/"),
+			DiscoveryBackend:         discoveryBackend,
+			Discovery: discovery.Config{
+				Username: discoveryUsername,
+				Password: discoveryPassword,
+				TLS: transport.TLSInfo{
+					CAFile:   discoveryCAFile,
+					CertFile: discoveryCertFile,
+					KeyFile:  discoveryKeyFile,
+				},
+				ServerName: discoveryServerName,
+				Proxy:      discoveryProxy,
+			},
+			SeedEndpoints: splitURLs(seedEndpoints),
+			PeerTLS:       peerTLS,
+			ClientTLS:     clientTLS,
+			Username:      username,
+			Password:      password,
+		}, nil
+	}
+
+	var actionResult *EtcdConfig
+	app.Commands = []cli.Command{
+		discoveryServerCommand(),
+		watchdogCommand(config),
+		promoteCommand(config, &actionResult),
 	}
 	flag.CommandLine.VisitAll(func(f *flag.Flag) {
 		if !strings.HasPrefix(f.Name, "test.") {
@@ -179,44 +478,32 @@ func Run(args []string) (*EtcdConfig, string, error) {
 		}
 	})
 
-	var actionResult *EtcdConfig
 	app.Action = func(c *cli.Context) error {
 		glog.V(6).Infof("flags: %v", args)
 
-		err := checkFlags()
+		cfg, err := config()
 		if err != nil {
 			return err
 		}
 
-		// derive configuration values
-		if dataDir == "" {
-			dataDir = name + ".etcd"
-		}
-		fresh := true
-		if fileutil.Exist(dataDir) {
-			var fs []string
-			fs, err = fileutil.ReadDir(dataDir)
-			if err != nil {
+		if dryRun {
+			report, err := Plan(context.Background(), *cfg)
+			if report == nil {
 				return err
 			}
-			glog.V(6).Infof("Found the following files in %s: %v", dataDir, fs)
-			fresh = len(fs) == 0
+			bs, jsonErr := json.MarshalIndent(report, "", "  ")
+			if jsonErr != nil {
+				return jsonErr
+			}
+			fmt.Fprintln(c.App.Writer, string(bs))
+			if err != nil {
+				return fmt.Errorf("cluster join would fail: %v", err)
+			}
+			return nil
 		}
 
-		jr, err := join.Join(
-			discoveryURL,
-			name,
-			initialAdvertisePeerURLs,
-			fresh,
-			clientPort,
-			clusterSize,
-			join.Strategy(joinStrategy),
-		)
-		if err != nil {
-			return fmt.Errorf("cluster join failed: %v", err)
-		}
-		actionResult = &EtcdConfig{*jr, dataDir}
-		return nil
+		actionResult, err = Join(context.Background(), *cfg)
+		return err
 	}
 
 	err := app.Run(args)
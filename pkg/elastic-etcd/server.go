@@ -0,0 +1,54 @@
+package elastic
+
+import (
+	"net/http"
+
+	"github.com/codegangsta/cli"
+	"github.com/golang/glog"
+	"github.com/sttts/elastic-etcd/discovery/server"
+)
+
+func discoveryServerCommand() cli.Command {
+	var (
+		listenAddr   string
+		dataFile     string
+		advertiseURL string
+	)
+
+	return cli.Command{
+		Name:  "discovery-server",
+		Usage: "serve the discovery.etcd.io protocol from a file-persisted store",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "listen-addr",
+				Usage:       "the address to listen on",
+				EnvVar:      "ELASTIC_ETCD_DISCOVERY_SERVER_LISTEN_ADDR",
+				Value:       ":8087",
+				Destination: &listenAddr,
+			},
+			cli.StringFlag{
+				Name:        "data-file",
+				Usage:       "the file to persist the discovery tokens in, empty for in-memory only",
+				EnvVar:      "ELASTIC_ETCD_DISCOVERY_SERVER_DATA_FILE",
+				Value:       "discovery.json",
+				Destination: &dataFile,
+			},
+			cli.StringFlag{
+				Name:        "advertise-url",
+				Usage:       "the base url of new discovery tokens, default: derived from the request",
+				EnvVar:      "ELASTIC_ETCD_DISCOVERY_SERVER_ADVERTISE_URL",
+				Value:       "",
+				Destination: &advertiseURL,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			s, err := server.NewStore(dataFile)
+			if err != nil {
+				return err
+			}
+
+			glog.Infof("Serving discovery service on %s", listenAddr)
+			return http.ListenAndServe(listenAddr, server.New(s, advertiseURL))
+		},
+	}
+}
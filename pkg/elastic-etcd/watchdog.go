@@ -0,0 +1,33 @@
+package elastic
+
+import (
+	"time"
+
+	"github.com/codegangsta/cli"
+	"golang.org/x/net/context"
+)
+
+func watchdogCommand(config func() (*Config, error)) cli.Command {
+	var deadline time.Duration
+
+	return cli.Command{
+		Name:  "watchdog",
+		Usage: "remove the member of this instance again if etcd does not start before a deadline",
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:        "deadline",
+				Usage:       "the time etcd has to start and show up with its name in the member list",
+				EnvVar:      "ELASTIC_ETCD_WATCHDOG_DEADLINE",
+				Value:       5 * time.Minute,
+				Destination: &deadline,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := config()
+			if err != nil {
+				return err
+			}
+			return Watchdog(context.Background(), *cfg, deadline)
+		},
+	}
+}